@@ -0,0 +1,516 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/faisal-fawad/vistorrent/torrent"
+)
+
+const maxTorrentSize = 10 << 20      // Largest torrent file that can be uploaded
+const metadataWait = 2 * time.Minute // Max time to fetch the metadata of a magnet link before giving up
+
+// Serves the web page and a JSON API that controls the torrents of a session, where new torrents are
+// downloaded into a directory named after them within destination
+type api struct {
+	session     *torrent.Session
+	sched       *scheduler
+	destination string
+}
+
+// A torrent as listed by the API
+type torrentSummary struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+	Done        int    `json:"done"`  // Number of pieces that are done
+	Total       int    `json:"total"` // Number of pieces
+	Length      uint32 `json:"length"`
+	Destination string `json:"destination"`
+	Peers       int    `json:"peers"`
+	Strategy    string `json:"strategy"`
+}
+
+// A file of a torrent along with how much of it is done
+type fileProgress struct {
+	Index    int              `json:"index"` // Index of the file within the torrent, which is used to stream it
+	Path     string           `json:"path"`
+	Length   uint32           `json:"length"`
+	Done     int              `json:"done"`   // Number of pieces that overlap the file and are done
+	Pieces   int              `json:"pieces"` // Number of pieces that overlap the file
+	Priority torrent.Priority `json:"priority"`
+}
+
+// Rates in KiB/s where zero is unlimited
+type limitsBody struct {
+	Download *int `json:"download"`
+	Upload   *int `json:"upload"`
+}
+
+// A change of how the pieces of a torrent are picked, where every field may be left out. The priority
+// applies to the pieces from first to last, which default to the first and last piece
+type priorityBody struct {
+	Strategy *string           `json:"strategy"`
+	Priority *torrent.Priority `json:"priority"`
+	First    *int              `json:"first"`
+	Last     *int              `json:"last"`
+}
+
+// Creates the handler of every route
+func newAPI(session *torrent.Session, sched *scheduler, destination string) http.Handler {
+	a := &api{session, sched, destination}
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.Dir("frontend")))
+	mux.HandleFunc("GET /api/torrents", a.list)
+	mux.HandleFunc("POST /api/torrents", a.add)
+	mux.HandleFunc("GET /api/torrents/{id}", a.torrent(a.get))
+	mux.HandleFunc("DELETE /api/torrents/{id}", a.torrent(a.remove))
+	mux.HandleFunc("POST /api/torrents/{id}/pause", a.torrent(a.pause))
+	mux.HandleFunc("POST /api/torrents/{id}/resume", a.torrent(a.resume))
+	mux.HandleFunc("GET /api/torrents/{id}/files", a.torrent(a.files))
+	mux.HandleFunc("GET /api/torrents/{id}/files/{index}", a.torrent(a.file))
+	mux.HandleFunc("PUT /api/torrents/{id}/files/{index}/priority", a.torrent(a.setFilePriority))
+	mux.HandleFunc("GET /api/torrents/{id}/peers", a.torrent(a.peers))
+	mux.HandleFunc("GET /api/torrents/{id}/trackers", a.torrent(a.trackers))
+	mux.HandleFunc("GET /api/torrents/{id}/pieces", a.torrent(a.pieces))
+	mux.HandleFunc("GET /api/torrents/{id}/events", a.torrent(a.events))
+	mux.HandleFunc("GET /api/torrents/{id}/priorities", a.torrent(a.priorities))
+	mux.HandleFunc("PUT /api/torrents/{id}/priorities", a.torrent(a.setPriorities))
+	mux.HandleFunc("GET /api/torrents/{id}/limits", a.torrent(a.torrentLimits))
+	mux.HandleFunc("PUT /api/torrents/{id}/limits", a.torrent(a.setTorrentLimits))
+	mux.HandleFunc("GET /api/limits", a.limits)
+	mux.HandleFunc("PUT /api/limits", a.setLimits)
+	mux.HandleFunc("GET /ws", a.websocket)
+	return sameOrigin(mux)
+}
+
+// Rejects requests that change something when they come from a web page on another origin, since any
+// page could otherwise post a form to the API. Scripts do not send an origin so they are always allowed
+func sameOrigin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" && r.Method != http.MethodGet && r.Method != http.MethodHead {
+			parsed, err := url.Parse(origin)
+			if err != nil || parsed.Host != r.Host {
+				writeError(w, http.StatusForbidden, errors.New("cross-origin requests are not allowed"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Helper function to write a value as JSON
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// Helper function to write an error as JSON
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// Helper function to create a handler of a route about a single torrent, which is found by the id in its path
+func (a *api) torrent(handler func(w http.ResponseWriter, r *http.Request, d *torrent.Download)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		d, err := a.session.Get(r.PathValue("id"))
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		handler(w, r, d)
+	}
+}
+
+// Helper function to summarize a torrent
+func summarize(d *torrent.Download) torrentSummary {
+	status, err := d.Status()
+	done, total := d.Progress()
+	res := torrentSummary{d.ID(), d.Torrent.Name, status, "", done, total, d.Torrent.Length, d.Destination, len(d.Peers()), string(d.Strategy())}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+func (a *api) list(w http.ResponseWriter, r *http.Request) {
+	res := []torrentSummary{}
+	for _, d := range a.session.Torrents() {
+		res = append(res, summarize(d))
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// Adds a torrent that is either the body itself as application/x-bittorrent, the torrent field of a
+// multipart form, or a magnet link in the magnet field of a form or JSON body. The response to a magnet
+// link is sent once its metadata is fetched from peers
+func (a *api) add(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxTorrentSize)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var data []byte
+	var link string
+	var err error
+	switch mediaType {
+	case "application/x-bittorrent":
+		data, err = io.ReadAll(r.Body)
+	case "multipart/form-data":
+		link = r.FormValue("magnet")
+		if link != "" {
+			break
+		}
+		file, _, formErr := r.FormFile("torrent")
+		if formErr != nil {
+			writeError(w, http.StatusBadRequest, errors.New("expected a torrent field with a .torrent file or a magnet field"))
+			return
+		}
+		defer file.Close()
+		data, err = io.ReadAll(file)
+	case "application/json":
+		var body struct {
+			Magnet string `json:"magnet"`
+		}
+		if json.NewDecoder(r.Body).Decode(&body) != nil || body.Magnet == "" {
+			err = errors.New("expected a magnet field")
+		}
+		link = body.Magnet
+	default:
+		writeError(w, http.StatusUnsupportedMediaType, errors.New("expected application/x-bittorrent, multipart/form-data or application/json"))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var torr torrent.Torrent
+	if link != "" {
+		torr, err = a.fetch(w, r, link)
+		if err != nil {
+			return
+		}
+	} else {
+		torr, err = torrent.ParseMetainfo(data)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	files, err := onlyFiles(torr, r.URL.Query()["only"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	d, err := a.session.AddTorrent(torr, filepath.Join(a.destination, torr.Name), torrent.TorrentOptions{FilePriorities: files})
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, summarize(d))
+}
+
+// Helper function to get the torrent of a magnet link from peers, where any error is written as a response
+func (a *api) fetch(w http.ResponseWriter, r *http.Request, link string) (torrent.Torrent, error) {
+	magnet, err := torrent.ParseMagnet(link)
+	if err == nil && len(magnet.Trackers) == 0 {
+		err = errors.New("magnet link has no trackers, which are needed to find peers")
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return torrent.Torrent{}, err
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), metadataWait)
+	defer cancel()
+	torr, err := a.session.FetchMetadata(ctx, magnet)
+	if errors.Is(err, context.DeadlineExceeded) {
+		writeError(w, http.StatusGatewayTimeout, errors.New("no peer sent the metadata of the magnet link in time"))
+	} else if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+	}
+	return torr, err
+}
+
+func (a *api) get(w http.ResponseWriter, r *http.Request, d *torrent.Download) {
+	writeJSON(w, http.StatusOK, summarize(d))
+}
+
+// Removes a torrent while keeping any data that was downloaded
+func (a *api) remove(w http.ResponseWriter, r *http.Request, d *torrent.Download) {
+	err := a.session.RemoveTorrent(d.ID())
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *api) pause(w http.ResponseWriter, r *http.Request, d *torrent.Download) {
+	err := a.session.Pause(d.ID())
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, summarize(d))
+}
+
+func (a *api) resume(w http.ResponseWriter, r *http.Request, d *torrent.Download) {
+	err := a.session.Resume(d.ID())
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, summarize(d))
+}
+
+// Lists the files of a torrent along with the pieces of each file that are done
+func (a *api) files(w http.ResponseWriter, r *http.Request, d *torrent.Download) {
+	pieces := d.Pieces()
+	res := []fileProgress{}
+	priorities := d.FilePriorities()
+	for i, file := range d.Torrent.Files {
+		if file.Padding {
+			continue
+		}
+		progress := fileProgress{Index: i, Path: strings.Join(file.Path, "/"), Length: file.Length, Priority: priorities[i]}
+		first, last := d.Torrent.FilePieces(file)
+		for i := first; i <= last; i++ {
+			progress.Pieces++
+			if i < len(pieces) && pieces[i] {
+				progress.Done++
+			}
+		}
+		res = append(res, progress)
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// Serves a file of a torrent with support for range requests while it is still downloading. The pieces
+// that are requested are downloaded before any other piece, and the response waits for them to be verified
+func (a *api) file(w http.ResponseWriter, r *http.Request, d *torrent.Download) {
+	index, err := strconv.Atoi(r.PathValue("index"))
+	if err != nil || index < 0 || index >= len(d.Torrent.Files) || d.Torrent.Files[index].Padding {
+		writeError(w, http.StatusNotFound, errors.New("file not found"))
+		return
+	}
+	file := d.Torrent.Files[index]
+	name := file.Path[len(file.Path)-1]
+	reader := d.NewReader(r.Context(), file)
+	defer reader.Close()
+
+	// Without a type the start of the file is read to sniff one, which would wait for the first piece
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, name, time.Time{}, reader)
+}
+
+func (a *api) peers(w http.ResponseWriter, r *http.Request, d *torrent.Download) {
+	writeJSON(w, http.StatusOK, d.Peers())
+}
+
+// Lists the trackers of a torrent by tier, where only the announce URL is asked for peers
+func (a *api) trackers(w http.ResponseWriter, r *http.Request, d *torrent.Download) {
+	tiers := d.Torrent.AnnounceList
+	if len(tiers) == 0 {
+		tiers = [][]string{{d.Torrent.Announce}}
+	}
+	res := map[string]interface{}{"announce": d.Torrent.Announce, "tiers": tiers}
+	if last := d.LastAnnounce(); !last.Time.IsZero() {
+		announce := map[string]interface{}{"time": last.Time, "found": last.Found}
+		if last.Err != nil {
+			announce["error"] = last.Err.Error()
+		}
+		res["last_announce"] = announce
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// Gets the piece map of a torrent as a string with a 1 for every piece that is done and a 0 otherwise
+func (a *api) pieces(w http.ResponseWriter, r *http.Request, d *torrent.Download) {
+	pieceMap, done := pieceMap(d)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"done": done, "total": len(d.Torrent.PieceHashes), "map": pieceMap})
+}
+
+// Helper function to get the piece map of a torrent along with the number of pieces that are done
+func pieceMap(d *torrent.Download) (string, int) {
+	var builder strings.Builder
+	done := 0
+	for _, complete := range d.Pieces() {
+		if complete {
+			builder.WriteByte('1')
+			done++
+		} else {
+			builder.WriteByte('0')
+		}
+	}
+	return builder.String(), done
+}
+
+func (a *api) events(w http.ResponseWriter, r *http.Request, d *torrent.Download) {
+	streamDownload(w, r, a.session, d)
+}
+
+// Gets the strategy of a torrent and the priority of each piece as a string with one digit per piece,
+// from 0 for skip to 4 for now
+func (a *api) priorities(w http.ResponseWriter, r *http.Request, d *torrent.Download) {
+	writeJSON(w, http.StatusOK, priorityMap(d))
+}
+
+func (a *api) setPriorities(w http.ResponseWriter, r *http.Request, d *torrent.Download) {
+	var body priorityBody
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid priorities: %w", err))
+		return
+	}
+	err = body.apply(d)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	a.priorities(w, r, d)
+}
+
+// Helper function to get the strategy and priorities of a torrent
+func priorityMap(d *torrent.Download) map[string]interface{} {
+	var builder strings.Builder
+	for _, priority := range d.Priorities() {
+		builder.WriteByte(byte('0' + priority))
+	}
+	return map[string]interface{}{"strategy": d.Strategy(), "pieces": builder.String()}
+}
+
+// Helper function to change the strategy and priorities of a torrent as given by a body
+func (body priorityBody) apply(d *torrent.Download) error {
+	if body.Strategy != nil {
+		strategy, err := torrent.ParseStrategy(*body.Strategy)
+		if err != nil {
+			return err
+		}
+		d.SetStrategy(strategy)
+	}
+	if body.Priority == nil {
+		if body.First != nil || body.Last != nil {
+			return errors.New("expected a priority for the pieces")
+		}
+		return nil
+	}
+	first, last := 0, len(d.Torrent.PieceHashes)-1
+	if body.First != nil {
+		first = *body.First
+	}
+	if body.Last != nil {
+		last = *body.Last
+	}
+	return d.SetPriority(first, last, *body.Priority)
+}
+
+// Sets the priority of a file, where skipped files are not downloaded unless they share a piece with a
+// wanted file
+func (a *api) setFilePriority(w http.ResponseWriter, r *http.Request, d *torrent.Download) {
+	index, err := strconv.Atoi(r.PathValue("index"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, errors.New("file not found"))
+		return
+	}
+	var body struct {
+		Priority *torrent.Priority `json:"priority"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.Priority == nil {
+		writeError(w, http.StatusBadRequest, errors.New("expected a priority"))
+		return
+	}
+	err = d.SetFilePriority(index, *body.Priority)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	a.files(w, r, d)
+}
+
+func (a *api) torrentLimits(w http.ResponseWriter, r *http.Request, d *torrent.Download) {
+	limits := d.Limits()
+	writeJSON(w, http.StatusOK, map[string]int{"download": limits.Download.Rate() / 1024, "upload": limits.Upload.Rate() / 1024})
+}
+
+func (a *api) setTorrentLimits(w http.ResponseWriter, r *http.Request, d *torrent.Download) {
+	download, upload, err := readLimits(r, d.Limits().Download.Rate()/1024, d.Limits().Upload.Rate()/1024)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	d.Limits().Set(download*1024, upload*1024)
+	a.torrentLimits(w, r, d)
+}
+
+// Gets the limits of the session, where the rates that apply right now differ from the configured rates
+// whenever a rule of the schedule applies
+func (a *api) limits(w http.ResponseWriter, r *http.Request) {
+	download, upload := a.sched.rates()
+	writeJSON(w, http.StatusOK, map[string]int{
+		"download":         download / 1024,
+		"upload":           upload / 1024,
+		"current_download": a.session.Limits().Download.Rate() / 1024,
+		"current_upload":   a.session.Limits().Upload.Rate() / 1024,
+	})
+}
+
+func (a *api) setLimits(w http.ResponseWriter, r *http.Request) {
+	download, upload := a.sched.rates()
+	newDownload, newUpload, err := readLimits(r, download/1024, upload/1024)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	a.sched.set(newDownload*1024, newUpload*1024)
+	a.limits(w, r)
+}
+
+// Helper function to read rates in KiB/s from a request, where a missing rate keeps its current value
+func readLimits(r *http.Request, download int, upload int) (int, int, error) {
+	var body limitsBody
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid limits: %w", err)
+	}
+	return body.rates(download, upload)
+}
+
+// Helper function to get the rates in KiB/s of a body, where a missing rate keeps its current value
+func (body limitsBody) rates(download int, upload int) (int, int, error) {
+	if body.Download != nil {
+		download = *body.Download
+	}
+	if body.Upload != nil {
+		upload = *body.Upload
+	}
+	if download < 0 || upload < 0 {
+		return 0, 0, errors.New("limits can't be negative")
+	}
+	return download, upload, nil
+}
+
+// Helper function to serve a handler until the server fails, which is only logged since the download
+// keeps going without it
+func serveWeb(addr string, handler http.Handler) {
+	server := &http.Server{Addr: addr, Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	err := server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
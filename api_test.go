@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFileRange(t *testing.T) {
+	data := make([]byte, 40000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	disk := bytes.Clone(data)
+	disk[0]++ // The first piece is missing and never arrives
+	server, d := testAPI(t, data, disk)
+
+	// A range after the first piece is served without waiting for it
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/api/torrents/"+d.ID()+"/files/0", nil)
+	req.Header.Set("Range", "bytes=20000-20009")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusPartialContent || !bytes.Equal(body, data[20000:20010]) {
+		t.Errorf("expected: %v -> got: %s %v", data[20000:20010], res.Status, body)
+	}
+	if got := res.Header.Get("Content-Type"); got != "application/octet-stream" {
+		t.Errorf("expected: %s -> got: %s", "application/octet-stream", got)
+	}
+}
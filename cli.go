@@ -0,0 +1,490 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/faisal-fawad/vistorrent/torrent"
+)
+
+// How much is printed, where each level includes the ones before it
+const (
+	levelError = iota // Only errors
+	levelInfo         // Progress and what the command is doing
+	levelDebug        // Everything the library does, such as failed peers
+)
+
+var logLevels = map[string]int{"error": levelError, "info": levelInfo, "debug": levelDebug}
+
+var verbosity = levelInfo // The level of the running command
+
+// Prints a message to stderr unless the log level is below info
+func logInfo(a ...interface{}) {
+	if verbosity >= levelInfo {
+		fmt.Fprintln(os.Stderr, a...)
+	}
+}
+
+// Settings shared by the commands, which are read from the config file and then overridden by flags.
+// Rates are in KiB/s and zero is unlimited
+type config struct {
+	Port             int      `json:"port"`       // The port that peers connect to
+	HTTPHost         string   `json:"http_host"`  // The address that the web page listens on
+	HTTPPort         int      `json:"http_port"`  // The port of the web page and API
+	MaxActive        int      `json:"max_active"` // Max number of torrents downloading at once
+	Destination      string   `json:"destination"`
+	DownloadLimit    int      `json:"download_limit"`
+	UploadLimit      int      `json:"upload_limit"`
+	Schedule         []string `json:"schedule"`
+	Blocklist        string   `json:"blocklist"`
+	PeerIdPrefix     string   `json:"peer_id_prefix"`
+	LogLevel         string   `json:"log_level"`
+	HandshakeTimeout string   `json:"handshake_timeout"` // A duration such as 3s
+	Strategy         string   `json:"strategy"`          // How pieces are picked, one of rarest, sequential or streaming
+	Only             []string `json:"-"`                 // Patterns of the files to download, which only exist as a flag
+}
+
+// Helper function to get the settings that apply when neither the config file nor a flag sets them
+func defaultConfig() config {
+	return config{
+		Port:             6881,
+		HTTPHost:         "localhost",
+		HTTPPort:         8080,
+		Destination:      ".",
+		PeerIdPrefix:     "-VT0001-",
+		LogLevel:         "info",
+		HandshakeTimeout: torrent.DefaultHandshakeTimeout.String(),
+		Strategy:         string(torrent.StrategyRarest),
+	}
+}
+
+// Reads the config file at a path, which is JSON when its extension is .json and TOML otherwise. When no
+// path is given, config.toml or config.json in the vistorrent directory of the user config directory is
+// read if it exists
+func loadConfig(path string) (config, error) {
+	cfg := defaultConfig()
+	if path == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return cfg, nil
+		}
+		for _, name := range []string{"config.toml", "config.json"} {
+			candidate := filepath.Join(dir, "vistorrent", name)
+			if _, err := os.Stat(candidate); err == nil {
+				path = candidate
+				break
+			}
+		}
+		if path == "" {
+			return cfg, nil
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if filepath.Ext(path) != ".json" {
+		values, err := parseTOML(string(data))
+		if err != nil {
+			return cfg, fmt.Errorf("%s: %w", path, err)
+		}
+		data, _ = json.Marshal(values)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&cfg)
+	if err != nil {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Helper function to find the value of the config flag before any other flag is parsed, since the config
+// file provides the defaults of the other flags
+func configPath(args []string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name, value, found := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name != "config" {
+			continue
+		}
+		if found {
+			return value
+		}
+		if i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// A list flag that replaces the list from the config file the first time it is given
+type replaceFlag struct {
+	values *[]string
+	set    bool
+}
+
+func (r *replaceFlag) String() string {
+	if r.values == nil {
+		return ""
+	}
+	return strings.Join(*r.values, ",")
+}
+
+func (r *replaceFlag) Set(value string) error {
+	if !r.set {
+		*r.values = nil
+		r.set = true
+	}
+	*r.values = append(*r.values, value)
+	return nil
+}
+
+// Creates the flags of a command that downloads, whose defaults come from the config file
+func commandFlags(name string, args []string) (*flag.FlagSet, *config, error) {
+	cfg, err := loadConfig(configPath(args))
+	if err != nil {
+		return nil, nil, err
+	}
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.String("config", "", "a TOML or JSON config file whose values are overridden by flags")
+	flags.StringVar(&cfg.Destination, "o", cfg.Destination, "directory to download into")
+	flags.IntVar(&cfg.Port, "port", cfg.Port, "port that peers connect to")
+	flags.StringVar(&cfg.HTTPHost, "http-host", cfg.HTTPHost, "address that the web page and API listen on, which anyone who can reach it can control")
+	flags.IntVar(&cfg.HTTPPort, "http-port", cfg.HTTPPort, "port of the web page and API")
+	flags.IntVar(&cfg.MaxActive, "max-active", cfg.MaxActive, "max number of torrents downloading at once, 0 is unlimited")
+	flags.IntVar(&cfg.DownloadLimit, "download-limit", cfg.DownloadLimit, "max download rate in KiB/s, 0 is unlimited")
+	flags.IntVar(&cfg.UploadLimit, "upload-limit", cfg.UploadLimit, "max upload rate in KiB/s, 0 is unlimited")
+	flags.Var(&replaceFlag{values: &cfg.Schedule}, "schedule", "rates for a time of day as [weekdays ]HH:MM-HH:MM=<download>/<upload> in KiB/s, can be repeated")
+	flags.StringVar(&cfg.Blocklist, "blocklist", cfg.Blocklist, "an eMule, PeerGuardian or CIDR list of addresses to block")
+	flags.StringVar(&cfg.PeerIdPrefix, "peer-id-prefix", cfg.PeerIdPrefix, "start of our peer id, at most 20 bytes")
+	flags.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "one of error, info or debug")
+	flags.StringVar(&cfg.HandshakeTimeout, "handshake-timeout", cfg.HandshakeTimeout, "max time to connect to a peer and exchange handshakes")
+	flags.Var(&replaceFlag{values: &cfg.Only}, "only", "only download files whose path or name matches a glob such as '*.mkv', can be repeated")
+	flags.StringVar(&cfg.Strategy, "strategy", cfg.Strategy, "how pieces are picked, one of rarest, sequential or streaming")
+	return flags, &cfg, nil
+}
+
+// Helper function to get the priority of each file of a torrent when only the files that match one of
+// some glob patterns are downloaded. A pattern matches the path of a file within the torrent, such as
+// season1/*.mkv, or its name alone. Returns nil when there are no patterns
+func onlyFiles(torr torrent.Torrent, patterns []string) ([]torrent.Priority, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern: %s", pattern)
+		}
+	}
+	priorities := make([]torrent.Priority, len(torr.Files))
+	matched := false
+	for i, file := range torr.Files {
+		priorities[i] = torrent.PrioritySkip
+		if file.Padding {
+			continue
+		}
+		for _, pattern := range patterns {
+			full, _ := path.Match(pattern, strings.Join(file.Path, "/"))
+			name, _ := path.Match(pattern, file.Path[len(file.Path)-1])
+			if full || name {
+				priorities[i] = torrent.PriorityNormal
+				matched = true
+				break
+			}
+		}
+	}
+	if !matched {
+		return nil, fmt.Errorf("no file of %s matches %s", torr.Name, strings.Join(patterns, ", "))
+	}
+	return priorities, nil
+}
+
+// Applies a schedule to the limits of a session, where the rates that apply outside of the rules can be
+// changed while it runs. Rates are in bytes per second. It is safe for concurrent use
+type scheduler struct {
+	mutex    sync.Mutex
+	limits   *torrent.Limits // The limits of the session that the schedule changes
+	rules    torrent.Schedule
+	download int
+	upload   int
+	stop     chan struct{} // Closed to stop the schedule, nil once it is closed
+}
+
+// Changes the rates that apply outside of the rules, which restarts the schedule
+func (s *scheduler) set(download int, upload int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stop != nil {
+		close(s.stop)
+	}
+	s.download, s.upload = download, upload
+	s.limits.Set(s.rules.Rates(time.Now(), download, upload)) // Applies before set returns
+	s.stop = make(chan struct{})
+	go s.rules.Run(s.limits, download, upload, s.stop)
+}
+
+// Gets the rates that apply outside of the rules
+func (s *scheduler) rates() (int, int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.download, s.upload
+}
+
+// Stops the schedule, which leaves the limits as they are
+func (s *scheduler) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+}
+
+// Checks the settings and sets the log level of the commands, then gets the options of a session whose
+// limits follow the schedule until ctx is cancelled
+func (cfg *config) apply(ctx context.Context) (torrent.SessionOptions, *scheduler, error) {
+	level, ok := logLevels[cfg.LogLevel]
+	if !ok {
+		return torrent.SessionOptions{}, nil, fmt.Errorf("invalid log level: %s", cfg.LogLevel)
+	}
+	if cfg.Port <= 0 || cfg.Port > 65535 || cfg.HTTPPort <= 0 || cfg.HTTPPort > 65535 {
+		return torrent.SessionOptions{}, nil, errors.New("ports must be between 1 and 65535")
+	}
+	if cfg.DownloadLimit < 0 || cfg.UploadLimit < 0 || cfg.MaxActive < 0 {
+		return torrent.SessionOptions{}, nil, errors.New("limits and max active can't be negative")
+	}
+	if len(cfg.PeerIdPrefix) > 20 {
+		return torrent.SessionOptions{}, nil, errors.New("peer id prefix must be at most 20 bytes")
+	}
+	timeout, err := time.ParseDuration(cfg.HandshakeTimeout)
+	if err != nil || timeout <= 0 {
+		return torrent.SessionOptions{}, nil, fmt.Errorf("invalid handshake timeout: %s", cfg.HandshakeTimeout)
+	}
+	strategy, err := torrent.ParseStrategy(cfg.Strategy)
+	if err != nil {
+		return torrent.SessionOptions{}, nil, err
+	}
+
+	// Rules of the schedule take priority over the limits whenever they apply
+	var rules torrent.Schedule
+	for _, text := range cfg.Schedule {
+		rule, err := torrent.ParseScheduleRule(text)
+		if err != nil {
+			return torrent.SessionOptions{}, nil, err
+		}
+		rules = append(rules, rule)
+	}
+	opts := torrent.SessionOptions{MaxActive: cfg.MaxActive, Port: uint16(cfg.Port), PeerIdPrefix: cfg.PeerIdPrefix, Strategy: strategy,
+		Limits: torrent.NewLimits(0, 0), HandshakeTimeout: timeout, Output: io.Discard}
+	if cfg.Blocklist != "" {
+		opts.Filter, err = torrent.LoadIPFilter(cfg.Blocklist)
+		if err != nil {
+			return torrent.SessionOptions{}, nil, err
+		}
+	}
+
+	verbosity = level
+	if level >= levelDebug {
+		opts.Output = os.Stderr
+	}
+	sched := &scheduler{limits: opts.Limits, rules: rules}
+	sched.set(cfg.DownloadLimit*1024, cfg.UploadLimit*1024)
+	context.AfterFunc(ctx, sched.close)
+	if opts.Filter != nil {
+		logInfo(fmt.Sprintf("loaded %d blocked address ranges", opts.Filter.Len()))
+	}
+	return opts, sched, nil
+}
+
+// Parses the subset of TOML that the config file needs: comments and key/value pairs whose values are
+// strings, integers, booleans or arrays of them. Tables are not supported since every setting is top level
+func parseTOML(text string) (map[string]interface{}, error) {
+	p := tomlParser{text, 0, 1}
+	res := make(map[string]interface{})
+	for {
+		p.skip(true)
+		if p.pos >= len(p.text) {
+			return res, nil
+		}
+		if p.text[p.pos] == '[' {
+			return nil, p.errorf("tables are not supported")
+		}
+		key, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		p.skip(false)
+		if p.pos >= len(p.text) || p.text[p.pos] != '=' {
+			return nil, p.errorf("expected = after %s", key)
+		}
+		p.pos++
+		p.skip(false)
+		value, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		if _, found := res[key]; found {
+			return nil, p.errorf("duplicate key %s", key)
+		}
+		res[key] = value
+		p.skip(false)
+		if p.pos < len(p.text) && p.text[p.pos] != '\n' && p.text[p.pos] != '\r' {
+			return nil, p.errorf("expected a new line after the value of %s", key)
+		}
+	}
+}
+
+// The state of parsing a TOML document
+type tomlParser struct {
+	text string
+	pos  int
+	line int
+}
+
+// Helper function to create an error at the current line
+func (p *tomlParser) errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("line %d: %s", p.line, fmt.Sprintf(format, a...))
+}
+
+// Helper function to skip spaces and comments, along with new lines if lines is true
+func (p *tomlParser) skip(lines bool) {
+	for p.pos < len(p.text) {
+		switch c := p.text[p.pos]; {
+		case c == ' ' || c == '\t':
+			p.pos++
+		case c == '#':
+			for p.pos < len(p.text) && p.text[p.pos] != '\n' {
+				p.pos++
+			}
+		case lines && (c == '\n' || c == '\r'):
+			if c == '\n' {
+				p.line++
+			}
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+// Helper function to parse a bare or quoted key
+func (p *tomlParser) key() (string, error) {
+	if p.text[p.pos] == '"' || p.text[p.pos] == '\'' {
+		return p.str()
+	}
+	start := p.pos
+	for p.pos < len(p.text) {
+		c := p.text[p.pos]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			break
+		}
+		p.pos++
+	}
+	if start == p.pos {
+		return "", p.errorf("expected a key")
+	}
+	return p.text[start:p.pos], nil
+}
+
+// Helper function to parse a value
+func (p *tomlParser) value() (interface{}, error) {
+	if p.pos >= len(p.text) {
+		return nil, p.errorf("expected a value")
+	}
+	switch p.text[p.pos] {
+	case '"', '\'':
+		return p.str()
+	case '[':
+		p.pos++
+		values := []interface{}{}
+		for {
+			p.skip(true)
+			if p.pos < len(p.text) && p.text[p.pos] == ']' {
+				p.pos++
+				return values, nil
+			}
+			value, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+			p.skip(true)
+			if p.pos < len(p.text) && p.text[p.pos] == ',' {
+				p.pos++
+			} else if p.pos >= len(p.text) || p.text[p.pos] != ']' {
+				return nil, p.errorf("expected , or ] in array")
+			}
+		}
+	}
+
+	start := p.pos
+	for p.pos < len(p.text) && !strings.ContainsRune(" \t\r\n#,]", rune(p.text[p.pos])) {
+		p.pos++
+	}
+	word := p.text[start:p.pos]
+	switch word {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	n, err := parseTOMLInt(strings.ReplaceAll(word, "_", ""))
+	if err != nil {
+		return nil, p.errorf("invalid value %q", word)
+	}
+	return n, nil
+}
+
+// Helper function to parse an integer, which is decimal unless it starts with 0x, 0o or 0b. Unlike Go, a
+// leading zero does not make an integer octal
+func parseTOMLInt(word string) (int64, error) {
+	bases := map[string]int{"0x": 16, "0o": 8, "0b": 2}
+	if len(word) > 2 && bases[word[:2]] != 0 {
+		if word[2] == '+' || word[2] == '-' {
+			return 0, fmt.Errorf("prefixed integers have no sign: %s", word)
+		}
+		return strconv.ParseInt(word[2:], bases[word[:2]], 64)
+	}
+	return strconv.ParseInt(word, 10, 64)
+}
+
+// Helper function to parse a basic string with escapes or a literal string without them
+func (p *tomlParser) str() (string, error) {
+	quote := p.text[p.pos]
+	end := p.pos + 1
+	for end < len(p.text) && p.text[end] != quote && p.text[end] != '\n' {
+		if quote == '"' && p.text[end] == '\\' {
+			end++
+		}
+		end++
+	}
+	if end >= len(p.text) || p.text[end] != quote {
+		return "", p.errorf("unterminated string")
+	}
+	raw := p.text[p.pos+1 : end]
+	p.pos = end + 1
+	if quote == '\'' {
+		return raw, nil
+	}
+	res, err := strconv.Unquote(`"` + raw + `"`)
+	if err != nil {
+		return "", p.errorf("invalid string %q", raw)
+	}
+	return res, nil
+}
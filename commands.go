@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+
+	"github.com/faisal-fawad/vistorrent/torrent"
+)
+
+// Checks that the data of a torrent is complete and announces it to the tracker as complete. Uploading to
+// peers is not supported yet, so this is all that seeding does for now. The exit status is 0 once the
+// tracker knows about the data, 1 when the data is incomplete or the tracker fails and 2 on invalid input
+func seedCommand(args []string) int {
+	flags, cfg, err := commandFlags("seed", args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "invoke this command by using: ./vistorrent seed [flags] <input:file> [<data:path>]")
+		flags.PrintDefaults()
+	}
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		return 2
+	}
+	if len(positional) < 1 || len(positional) > 2 {
+		flags.Usage()
+		return 2
+	}
+	torr, err := torrent.ParseTorrent(positional[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	data := filepath.Join(cfg.Destination, torr.Name)
+	if len(positional) == 2 {
+		data = positional[1]
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	opts, _, err := cfg.apply(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	storage := torrent.NewFileStorage(&torr, data)
+	defer storage.Close()
+	res, err := torr.Verify(ctx, storage)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if !res.Complete() {
+		fmt.Fprintf(os.Stderr, "the data at %s is incomplete, run ./vistorrent verify for details\n", data)
+		return 1
+	}
+
+	session := torrent.NewSession(opts)
+	defer session.Close()
+	peers, err := torr.GetPeers(ctx, session.PeerId(), opts.Port, torr.Length, 0)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	logInfo(fmt.Sprintf("announced %s as complete, the tracker knows %d other peers", torr.Name, len(peers)))
+	logInfo("uploading to peers is not supported yet")
+	return 0
+}
+
+// Prints the magnet link of a torrent, the exit status is 0 on success and 2 on any error
+func magnetCommand(args []string) int {
+	flags := flag.NewFlagSet("magnet", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "invoke this command by using: ./vistorrent magnet <input:file>")
+		flags.PrintDefaults()
+	}
+	if flags.Parse(args) != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	torr, err := torrent.ParseTorrent(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	fmt.Println(torr.Magnet())
+	return 0
+}
+
+// Asks the tracker of a torrent how many peers it has, the exit status is 0 on success, 1 when the
+// tracker fails and 2 on invalid input
+func scrapeCommand(args []string) int {
+	flags := flag.NewFlagSet("scrape", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print the result as JSON")
+	timeout := flags.Duration("timeout", 15*time.Second, "max time to wait for the tracker")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "invoke this command by using: ./vistorrent scrape [flags] <input:file>")
+		flags.PrintDefaults()
+	}
+	if flags.Parse(args) != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	torr, err := torrent.ParseTorrent(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+	res, err := torr.Scrape(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *asJSON {
+		out, _ := json.MarshalIndent(res, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		fmt.Printf("seeders: %d  leechers: %d  completed: %d\n", res.Complete, res.Incomplete, res.Downloaded)
+	}
+	return 0
+}
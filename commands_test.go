@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/faisal-fawad/vistorrent/torrent"
+)
+
+func TestSeedCommand(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	left := make(chan string, 1)
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		left <- r.URL.Query().Get("left")
+		w.Write([]byte("d8:intervali60e5:peers0:e"))
+	}))
+	defer tracker.Close()
+
+	dir := t.TempDir()
+	data := filepath.Join(dir, "data")
+	os.WriteFile(data, make([]byte, 40000), 0644)
+	bencode, err := torrent.Create(torrent.CreateOptions{Path: data, PieceLength: 16384, Announce: tracker.URL + "/announce"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "data.torrent")
+	os.WriteFile(path, bencode, 0644)
+
+	// Complete data is announced with nothing left
+	if status := seedCommand([]string{"--log-level", "error", path, data}); status != 0 {
+		t.Fatalf("expected: status %d -> got: %d", 0, status)
+	}
+	if got := <-left; got != "0" {
+		t.Errorf("expected: left of %s -> got: %s", "0", got)
+	}
+
+	// Incomplete data is never announced
+	os.WriteFile(data, make([]byte, 20000), 0644)
+	if status := seedCommand([]string{"--log-level", "error", path, data}); status != 1 {
+		t.Errorf("expected: status %d -> got: %d", 1, status)
+	}
+	select {
+	case got := <-left:
+		t.Errorf("expected: no announce -> got: left of %s", got)
+	default:
+	}
+}
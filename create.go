@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/faisal-fawad/vistorrent/torrent"
+)
+
+// A flag that can be given multiple times
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// Creates a torrent file from a file or directory, the exit status is 0 on success and 2 on any error
+func createCommand(args []string) int {
+	var trackers, webSeeds listFlag
+	flags := flag.NewFlagSet("create", flag.ContinueOnError)
+	flags.Var(&trackers, "a", "tracker URL, may be repeated with each use being a tier and commas separating trackers within a tier")
+	flags.Var(&webSeeds, "w", "web seed URL, may be repeated")
+	output := flags.String("o", "", "output file (default <name>.torrent)")
+	comment := flags.String("c", "", "comment")
+	pieceLength := flags.Uint("l", 0, "piece length in bytes, chosen automatically when zero")
+	private := flags.Bool("p", false, "mark the torrent as private")
+	noDate := flags.Bool("no-date", false, "omit the creation date")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "invoke this command by using: ./vistorrent create -a <tracker> [flags] <input:path>")
+		flags.PrintDefaults()
+	}
+	if flags.Parse(args) != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	// Checked before converting, since a length that does not fit in 32 bits would otherwise become zero
+	if *pieceLength != 0 && (*pieceLength < 16384 || *pieceLength > math.MaxUint32 || *pieceLength&(*pieceLength-1) != 0) {
+		fmt.Fprintln(os.Stderr, "piece length must be a power of two of at least 16 KiB")
+		flags.Usage()
+		return 2
+	}
+
+	opts := torrent.CreateOptions{
+		Path:        flags.Arg(0),
+		PieceLength: uint32(*pieceLength),
+		URLList:     webSeeds,
+		Comment:     *comment,
+		CreatedBy:   "vistorrent",
+		Private:     *private,
+	}
+	for _, tier := range trackers {
+		opts.AnnounceList = append(opts.AnnounceList, strings.Split(tier, ","))
+	}
+	if !*noDate {
+		opts.CreationDate = time.Now()
+	}
+
+	bencode, err := torrent.Create(opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if *output == "" {
+		*output = filepath.Base(filepath.Clean(opts.Path)) + ".torrent"
+	}
+	err = os.WriteFile(*output, bencode, 0644)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	torr, _ := torrent.ParseMetainfo(bencode)
+	fmt.Printf("Created %s with info hash %x \n", *output, torr.InfoHash)
+	return 0
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/faisal-fawad/vistorrent/torrent"
+)
+
+func TestCreatePieceLength(t *testing.T) {
+	dir := t.TempDir()
+	data := filepath.Join(dir, "data")
+	os.WriteFile(data, make([]byte, 100000), 0644)
+	output := filepath.Join(dir, "data.torrent")
+
+	// Lengths that are not powers of two of at least 16 KiB, or that do not fit in 32 bits, are refused
+	for _, length := range []string{"4294967296", "8589934592", "16383", "8192", "49152"} {
+		if status := createCommand([]string{"-a", "http://example.com/announce", "-o", output, "-l", length, data}); status != 2 {
+			t.Errorf("-l %s: expected: status %d -> got: %d", length, 2, status)
+		}
+		if _, err := os.Stat(output); err == nil {
+			t.Fatalf("-l %s: expected: no torrent to be written", length)
+		}
+	}
+
+	if status := createCommand([]string{"-a", "http://example.com/announce", "-o", output, "-l", "32768", data}); status != 0 {
+		t.Fatalf("expected: status %d -> got: %d", 0, status)
+	}
+	torr, err := torrent.ParseTorrent(output)
+	if err != nil || torr.PieceLength != 32768 {
+		t.Errorf("expected: piece length %d -> got: %d (%v)", 32768, torr.PieceLength, err)
+	}
+}
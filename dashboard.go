@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/faisal-fawad/vistorrent/torrent"
+)
+
+const diffInterval = time.Second // Time between checks of the torrents for changes
+
+// A command sent by the dashboard over its WebSocket, whose id is echoed in the reply
+type wsCommand struct {
+	ID      json.RawMessage `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Torrent string          `json:"torrent,omitempty"`
+	File    *int            `json:"file,omitempty"`
+	limitsBody
+	priorityBody
+}
+
+// A dashboard connected over a WebSocket, which receives the torrents it subscribed to
+type wsClient struct {
+	api           *api
+	conn          *wsConn
+	mutex         sync.Mutex
+	subscriptions map[string]context.CancelFunc
+}
+
+// Serves the live channel of the dashboard. Once connected the dashboard receives every torrent, followed by
+// a diff whenever one of them changes. Subscribing to a torrent sends its piece map and peers followed by
+// every event of the torrent, so a dashboard that reconnects shows the same state as before
+func (a *api) websocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	client := &wsClient{api: a, conn: conn, subscriptions: make(map[string]context.CancelFunc)}
+	defer conn.Close()
+	defer cancel()
+	go client.watch(ctx)
+
+	for {
+		opcode, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if opcode != opText {
+			continue
+		}
+		var command wsCommand
+		err = json.Unmarshal(message, &command)
+		if err != nil {
+			client.send(map[string]interface{}{"type": "error", "error": "invalid command: " + err.Error()})
+			continue
+		}
+		res, err := client.handle(ctx, command)
+		if err != nil {
+			client.send(map[string]interface{}{"type": "error", "id": command.ID, "error": err.Error()})
+		} else {
+			client.send(map[string]interface{}{"type": "result", "id": command.ID, "result": res})
+		}
+	}
+}
+
+// Helper function to send a message as JSON, where a client that stopped reading is closed
+func (c *wsClient) send(message interface{}) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+	err = c.conn.WriteMessage(opText, data)
+	if err != nil {
+		c.conn.conn.Close() // Stops the loop that reads commands
+	}
+}
+
+// Helper function to run a command, which returns what is sent back as its result
+func (c *wsClient) handle(ctx context.Context, command wsCommand) (interface{}, error) {
+	if command.Type == "limits" && command.Torrent == "" {
+		download, upload := c.api.sched.rates()
+		newDownload, newUpload, err := command.rates(download/1024, upload/1024)
+		if err != nil {
+			return nil, err
+		}
+		c.api.sched.set(newDownload*1024, newUpload*1024)
+		return map[string]int{"download": newDownload, "upload": newUpload}, nil
+	}
+
+	d, err := c.api.session.Get(command.Torrent)
+	if err != nil {
+		return nil, err
+	}
+	switch command.Type {
+	case "subscribe":
+		c.subscribe(ctx, d)
+		return nil, nil
+	case "unsubscribe":
+		c.unsubscribe(d.ID())
+		return nil, nil
+	case "pause":
+		err = c.api.session.Pause(d.ID())
+	case "resume":
+		err = c.api.session.Resume(d.ID())
+	case "remove":
+		c.unsubscribe(d.ID())
+		return nil, c.api.session.RemoveTorrent(d.ID())
+	case "limits":
+		limits := d.Limits()
+		download, upload, err := command.rates(limits.Download.Rate()/1024, limits.Upload.Rate()/1024)
+		if err != nil {
+			return nil, err
+		}
+		limits.Set(download*1024, upload*1024)
+		return map[string]int{"download": download, "upload": upload}, nil
+	case "priority":
+		err = command.priorityBody.apply(d)
+		if err != nil {
+			return nil, err
+		}
+		return priorityMap(d), nil
+	case "file_priority":
+		if command.File == nil || command.Priority == nil {
+			return nil, errors.New("expected a file and a priority")
+		}
+		err = d.SetFilePriority(*command.File, *command.Priority)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"file": *command.File, "priority": *command.Priority}, nil
+	default:
+		return nil, errors.New("unknown command: " + command.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return summarize(d), nil
+}
+
+// Helper function to stop sending the events of a torrent
+func (c *wsClient) unsubscribe(id string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if stop, ok := c.subscriptions[id]; ok {
+		stop()
+		delete(c.subscriptions, id)
+	}
+}
+
+// Helper function to send the snapshot of a torrent followed by its events until unsubscribed. The events
+// are subscribed to before the snapshot is taken, so none of them are missed
+func (c *wsClient) subscribe(ctx context.Context, d *torrent.Download) {
+	c.mutex.Lock()
+	if _, ok := c.subscriptions[d.ID()]; ok {
+		c.mutex.Unlock()
+		return
+	}
+	ctx, stop := context.WithCancel(ctx)
+	c.subscriptions[d.ID()] = stop
+	c.mutex.Unlock()
+
+	events := c.api.session.Events().Subscribe(ctx)
+	pieces, done := pieceMap(d)
+	c.send(map[string]interface{}{
+		"type":    "snapshot",
+		"torrent": d.ID(),
+		"started": d.StartedEvent(),
+		"summary": summarize(d),
+		"pieces":  pieces,
+		"done":    done,
+		"peers":   d.Peers(),
+	})
+	go func() {
+		for event := range events {
+			if event.Torrent == d.ID() {
+				c.send(map[string]interface{}{"type": "event", "torrent": d.ID(), "event": event})
+			}
+		}
+		// A dashboard that fell too far behind reconnects, which sends it a new snapshot
+		if ctx.Err() == nil {
+			c.conn.conn.Close()
+		}
+	}()
+}
+
+// Helper function to send every torrent and then what changed about them until the client is gone
+func (c *wsClient) watch(ctx context.Context) {
+	last := make(map[string]map[string]interface{})
+	summaries := []torrentSummary{}
+	for _, d := range c.api.session.Torrents() {
+		summary := summarize(d)
+		summaries = append(summaries, summary)
+		last[d.ID()] = fields(summary)
+	}
+	c.send(map[string]interface{}{"type": "torrents", "torrents": summaries})
+
+	ticker := time.NewTicker(diffInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		current := make(map[string]map[string]interface{})
+		for _, d := range c.api.session.Torrents() {
+			summary := summarize(d)
+			current[d.ID()] = fields(summary)
+			previous, ok := last[d.ID()]
+			if !ok {
+				c.send(map[string]interface{}{"type": "added", "torrent": d.ID(), "summary": summary})
+				continue
+			}
+			changes := make(map[string]interface{})
+			for key, value := range current[d.ID()] {
+				if previous[key] != value {
+					changes[key] = value
+				}
+			}
+			for key := range previous {
+				if _, ok := current[d.ID()][key]; !ok {
+					changes[key] = nil
+				}
+			}
+			if len(changes) > 0 {
+				c.send(map[string]interface{}{"type": "diff", "torrent": d.ID(), "changes": changes})
+			}
+		}
+		for id := range last {
+			if _, ok := current[id]; !ok {
+				c.unsubscribe(id)
+				c.send(map[string]interface{}{"type": "removed", "torrent": id})
+			}
+		}
+		last = current
+	}
+}
+
+// Helper function to get the fields of a summary by their JSON names, so that two summaries can be compared
+func fields(summary torrentSummary) map[string]interface{} {
+	res := make(map[string]interface{})
+	data, _ := json.Marshal(summary)
+	json.Unmarshal(data, &res)
+	return res
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/faisal-fawad/vistorrent/torrent"
+)
+
+// Helper function to serve the API of a session with a torrent of data, where disk is what is already on
+// disk. The torrent has pieces of 16 KiB and a tracker that can't be reached, so missing pieces never arrive
+func testAPI(t *testing.T, data []byte, disk []byte) (*httptest.Server, *torrent.Download) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data")
+	os.WriteFile(path, data, 0644)
+	bencode, err := torrent.Create(torrent.CreateOptions{Path: path, PieceLength: 16384, Announce: "http://127.0.0.1:1/announce"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	torr, err := torrent.ParseMetainfo(bencode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(path, disk, 0644)
+	session := torrent.NewSession(torrent.SessionOptions{})
+	t.Cleanup(func() { session.Close() })
+	d, err := session.AddTorrent(torr, path, torrent.TorrentOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(newAPI(session, &scheduler{}, dir))
+	t.Cleanup(server.Close)
+	return server, d
+}
+
+// Helper function to read the next message of the dashboard
+func readDashboard(t *testing.T, reader *bufio.Reader) map[string]interface{} {
+	frame, err := readServerFrame(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var message map[string]interface{}
+	json.Unmarshal(frame.payload, &message)
+	return message
+}
+
+func TestDashboardSubscribe(t *testing.T) {
+	data := make([]byte, 40000)
+	server, d := testAPI(t, data, data)
+	for range 200 {
+		if status, _ := d.Status(); status == torrent.StatusFinished {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Every torrent is sent once connected
+	conn, reader, _ := dialWebSocket(t, server.URL, nil)
+	message := readDashboard(t, reader)
+	torrents, _ := message["torrents"].([]interface{})
+	if message["type"] != "torrents" || len(torrents) != 1 {
+		t.Fatalf("expected: torrents -> got: %v", message)
+	}
+
+	// Subscribing sends the piece map before the result of the command
+	conn.Write(clientFrame(true, opText, []byte(`{"id": 1, "type": "subscribe", "torrent": "`+d.ID()+`"}`), true))
+	message = readDashboard(t, reader)
+	if message["type"] != "snapshot" || message["torrent"] != d.ID() || message["pieces"] != "111" || message["done"] != 3.0 {
+		t.Errorf("expected: snapshot -> got: %v", message)
+	}
+	message = readDashboard(t, reader)
+	if message["type"] != "result" || message["id"] != 1.0 {
+		t.Errorf("expected: result -> got: %v", message)
+	}
+
+	// Errors are sent back with the id of the command
+	conn.Write(clientFrame(true, opText, []byte(`{"id": "a", "type": "unknown", "torrent": "`+d.ID()+`"}`), true))
+	message = readDashboard(t, reader)
+	if text, _ := message["error"].(string); message["type"] != "error" || message["id"] != "a" || !strings.Contains(text, "unknown command") {
+		t.Errorf("expected: error -> got: %v", message)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/faisal-fawad/vistorrent/torrent"
+)
+
+const progressInterval = 500 * time.Millisecond // How often the progress bar is drawn
+const progressWidth = 30                        // Number of characters in the progress bar
+const rateSmoothing = 0.3                       // Weight of the newest sample of the download rate
+
+// Downloads a torrent file or magnet link without the web page while drawing progress in the terminal, the
+// exit status is 0 once the download is complete, 1 if the download fails, 2 on invalid input and 130 when
+// interrupted
+func downloadCommand(args []string) int {
+	flags, cfg, err := commandFlags("download", args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	quiet := flags.Bool("quiet", false, "print nothing except errors, the same as --log-level error")
+	asJSON := flags.Bool("json", false, "print every event as a line of JSON instead of a progress bar")
+	web := flags.Bool("web", false, "also serve the visualization and API on the HTTP port")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "invoke this command by using: ./vistorrent download [flags] <input:file|magnet> [-o <output:dir>]")
+		flags.PrintDefaults()
+	}
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		return 2
+	}
+	if len(positional) != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	// The torrent of a magnet link is only known once its metadata is fetched from peers
+	var magnet *torrent.Magnet
+	var torr torrent.Torrent
+	if strings.HasPrefix(positional[0], "magnet:") {
+		m, err := torrent.ParseMagnet(positional[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		magnet = &m
+	} else {
+		torr, err = torrent.ParseTorrent(positional[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+	if *quiet {
+		cfg.LogLevel = "error"
+	}
+
+	// Interrupting stops the download, which can be resumed later from what is on disk
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	opts, sched, err := cfg.apply(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	show := verbosity >= levelInfo && !*asJSON // Whether the progress bar is drawn
+	session := torrent.NewSession(opts)
+	defer session.Close()
+	err = session.Listen()
+	if err != nil && show {
+		fmt.Fprintln(os.Stderr, err) // Peers can still be dialed without a listener
+	}
+	if magnet != nil {
+		logInfo("fetching the metadata of", magnetName(*magnet))
+		torr, err = session.FetchMetadata(ctx, *magnet)
+		if ctx.Err() != nil {
+			return 130
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	files, err := onlyFiles(torr, cfg.Only)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	events := session.Events().Subscribe(ctx)
+	download, err := session.AddTorrent(torr, filepath.Join(cfg.Destination, torr.Name), torrent.TorrentOptions{FilePriorities: files})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if *web {
+		go serveWeb(net.JoinHostPort(cfg.HTTPHost, strconv.Itoa(cfg.HTTPPort)), newAPI(session, sched, cfg.Destination))
+	}
+
+	progress := newProgress(&torr, download.Priorities())
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok && ctx.Err() == nil {
+				fmt.Fprintln(os.Stderr, "\nevents fell too far behind, run the same command again to resume")
+				return 1
+			}
+			if !ok {
+				if show {
+					fmt.Fprintln(os.Stderr, "\ninterrupted, run the same command again to resume")
+				}
+				return 130
+			}
+			if event.Torrent != download.ID() {
+				continue
+			}
+			progress.update(event)
+			if *asJSON {
+				progress.printJSON(event)
+			}
+			switch event.Type {
+			case torrent.EventFinished:
+				if show {
+					progress.draw()
+					fmt.Fprintln(os.Stderr)
+				}
+				return 0
+			case torrent.EventError:
+				if show {
+					fmt.Fprintln(os.Stderr)
+				}
+				fmt.Fprintln(os.Stderr, event.Err)
+				return 1
+			}
+		case <-ticker.C:
+			progress.sample()
+			if show {
+				progress.draw()
+			}
+		}
+	}
+}
+
+// Helper function to parse flags that may come before or after positional arguments
+func parseInterspersed(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		err := flags.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+		if flags.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
+
+// Helper function to get how a magnet link is shown before its torrent is known
+func magnetName(magnet torrent.Magnet) string {
+	if magnet.Name != "" {
+		return magnet.Name
+	}
+	return hex.EncodeToString(magnet.HandshakeHash())
+}
+
+// The progress of a download as seen from its events, which only counts pieces that are not skipped
+type progress struct {
+	torr       *torrent.Torrent
+	wanted     []bool // Whether each piece is not skipped
+	done       int
+	total      int
+	length     int64 // Bytes of the pieces that are not skipped
+	bytes      int64 // Bytes of the pieces that are done
+	peers      map[string]bool
+	started    bool  // Whether data on disk has been checked, after which pieces count towards the rate
+	lastBytes  int64 // Bytes when the rate was last sampled
+	lastSample time.Time
+	rate       float64 // Smoothed download rate in bytes per second
+}
+
+// Helper function to create the progress of a torrent whose pieces have some priorities
+func newProgress(torr *torrent.Torrent, priorities []torrent.Priority) *progress {
+	p := &progress{torr: torr, wanted: make([]bool, len(priorities)), peers: make(map[string]bool), lastSample: time.Now()}
+	for i := range priorities {
+		if priorities[i] != torrent.PrioritySkip {
+			p.wanted[i] = true
+			p.total++
+			p.length += int64(torr.PieceSize(i))
+		}
+	}
+	return p
+}
+
+// Helper function to update the progress with an event
+func (p *progress) update(event torrent.Event) {
+	switch event.Type {
+	case torrent.EventPieceCompleted:
+		if p.wanted[event.Piece] {
+			p.done++
+			p.bytes += int64(p.torr.PieceSize(event.Piece))
+		}
+	case torrent.EventAnnounce:
+		// Pieces before the first announce were already on disk, so they do not count towards the rate
+		if !p.started {
+			p.started = true
+			p.lastBytes = p.bytes
+			p.lastSample = time.Now()
+		}
+	case torrent.EventPeerConnected:
+		p.peers[event.Peer] = true
+	case torrent.EventPeerDisconnected:
+		delete(p.peers, event.Peer)
+	}
+}
+
+// Helper function to sample the download rate, which is smoothed so that it does not jump around
+func (p *progress) sample() {
+	now := time.Now()
+	elapsed := now.Sub(p.lastSample).Seconds()
+	if !p.started || elapsed <= 0 {
+		return
+	}
+	current := float64(p.bytes-p.lastBytes) / elapsed
+	p.rate = rateSmoothing*current + (1-rateSmoothing)*p.rate
+	p.lastBytes = p.bytes
+	p.lastSample = now
+}
+
+// Helper function to estimate the time left, which is zero when it is unknown
+func (p *progress) eta() time.Duration {
+	if p.rate < 1 {
+		return 0
+	}
+	left := float64(p.length - p.bytes)
+	return time.Duration(left / p.rate * float64(time.Second)).Round(time.Second)
+}
+
+// Helper function to draw the progress bar over the previous one
+func (p *progress) draw() {
+	fraction := 0.0
+	if p.total > 0 {
+		fraction = float64(p.done) / float64(p.total)
+	}
+	filled := int(fraction * progressWidth)
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressWidth-filled)
+	eta := "--"
+	if d := p.eta(); d > 0 {
+		eta = d.String()
+	}
+	fmt.Fprintf(os.Stderr, "\r[%s] %5.1f%%  %d/%d pieces  %s/s  ETA %s  %d peers\033[K",
+		bar, fraction*100, p.done, p.total, formatBytes(p.rate), eta, len(p.peers))
+}
+
+// Helper function to print an event along with the progress as a line of JSON
+func (p *progress) printJSON(event torrent.Event) {
+	line := map[string]interface{}{
+		"type":    event.Type,
+		"time":    event.Time,
+		"done":    p.done,
+		"total":   p.total,
+		"peers":   len(p.peers),
+		"rate":    int64(p.rate),
+		"eta":     int64(p.eta().Seconds()),
+		"torrent": event.Torrent,
+	}
+	switch event.Type {
+	case torrent.EventPieceCompleted, torrent.EventHashFailed:
+		line["piece"] = event.Piece
+	case torrent.EventPeerConnected, torrent.EventPeerDisconnected, torrent.EventPeerBanned:
+		line["peer"] = event.Peer
+	case torrent.EventAnnounce:
+		line["found"] = event.Found
+	case torrent.EventStarted:
+		line["name"] = event.Name
+	}
+	if event.Err != nil {
+		line["error"] = event.Err.Error()
+	}
+	out, _ := json.Marshal(line)
+	fmt.Println(string(out))
+}
+
+// Helper function to format a number of bytes with a binary unit
+func formatBytes(bytes float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB"}
+	i := 0
+	for bytes >= 1024 && i < len(units)-1 {
+		bytes /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", bytes, units[i])
+}
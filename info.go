@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/faisal-fawad/vistorrent/torrent"
+)
+
+// The metainfo of a torrent as printed by the info command
+type torrentInfo struct {
+	Name         string       `json:"name"`
+	InfoHash     string       `json:"info_hash,omitempty"` // Empty for v2 only torrents
+	InfoHashV2   string       `json:"info_hash_v2,omitempty"`
+	Version      string       `json:"version"` // One of v1, v2 or hybrid
+	Length       uint32       `json:"length"`
+	PieceLength  uint32       `json:"piece_length"`
+	Pieces       int          `json:"pieces"`
+	Private      bool         `json:"private"`
+	CreatedBy    string       `json:"created_by,omitempty"`
+	CreationDate *time.Time   `json:"creation_date,omitempty"`
+	Comment      string       `json:"comment,omitempty"`
+	Trackers     [][]string   `json:"trackers"` // Tiers of trackers
+	WebSeeds     []string     `json:"web_seeds"`
+	Files        []fileDetail `json:"files"`
+}
+
+// A file of a torrent, where padding files are left out
+type fileDetail struct {
+	Path   []string `json:"path"`
+	Length uint32   `json:"length"`
+}
+
+// Prints the metainfo of a torrent without downloading it, the exit status is 0 on success and 2 on any error
+func infoCommand(args []string) int {
+	flags := flag.NewFlagSet("info", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print the metainfo as JSON")
+	raw := flags.Bool("raw", false, "print the whole torrent file as JSON, where strings that are not printable UTF-8 are written as hex: followed by their hex")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "invoke this command by using: ./vistorrent info [--json | --raw] <input:file>")
+		flags.PrintDefaults()
+	}
+	if flags.Parse(args) != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	if *raw {
+		bytes, err := os.ReadFile(flags.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		res, _, err := torrent.DecodeBencode(string(bytes))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		if metainfo, ok := res.(map[string]interface{}); ok {
+			delete(metainfo, "info bencoded") // Added by the decoder, not part of the file
+		}
+		out, _ := json.MarshalIndent(rawJSON(res), "", "  ")
+		fmt.Println(string(out))
+		return 0
+	}
+
+	torr, err := torrent.ParseTorrent(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	info := newTorrentInfo(&torr)
+	if *asJSON {
+		out, _ := json.MarshalIndent(info, "", "  ")
+		fmt.Println(string(out))
+		return 0
+	}
+	info.print(torr.MultiFile)
+	return 0
+}
+
+// Helper function to collect the metainfo of a torrent
+func newTorrentInfo(torr *torrent.Torrent) torrentInfo {
+	info := torrentInfo{
+		Name:        torr.Name,
+		Version:     "v1",
+		Length:      torr.Length,
+		PieceLength: torr.PieceLength,
+		Pieces:      len(torr.PieceHashes),
+		Private:     torr.Private,
+		CreatedBy:   torr.CreatedBy,
+		Comment:     torr.Comment,
+		Trackers:    torr.AnnounceList,
+		WebSeeds:    torr.URLList,
+		Files:       []fileDetail{},
+	}
+	if !torr.V2Only() {
+		info.InfoHash = hex.EncodeToString(torr.InfoHash)
+	}
+	if torr.InfoHashV2 != nil {
+		info.InfoHashV2 = hex.EncodeToString(torr.InfoHashV2)
+		info.Version = "v2"
+		if !torr.V2Only() {
+			info.Version = "hybrid"
+		}
+	}
+	if !torr.CreationDate.IsZero() {
+		info.CreationDate = &torr.CreationDate
+	}
+	// Torrents without an announce list only have the single tracker
+	if len(info.Trackers) == 0 {
+		info.Trackers = [][]string{{torr.Announce}}
+	}
+	if info.WebSeeds == nil {
+		info.WebSeeds = []string{}
+	}
+	for _, file := range torr.Files {
+		if !file.Padding {
+			info.Files = append(info.Files, fileDetail{file.Path, file.Length})
+		}
+	}
+	return info
+}
+
+// Helper function to print the metainfo for a person to read
+func (info *torrentInfo) print(multiFile bool) {
+	fmt.Printf("name:          %s\n", info.Name)
+	if info.InfoHash != "" {
+		fmt.Printf("info hash:     %s\n", info.InfoHash)
+	}
+	if info.InfoHashV2 != "" {
+		fmt.Printf("info hash v2:  %s\n", info.InfoHashV2)
+	}
+	fmt.Printf("version:       %s\n", info.Version)
+	fmt.Printf("size:          %s (%d bytes)\n", formatBytes(float64(info.Length)), info.Length)
+	fmt.Printf("piece length:  %s\n", formatBytes(float64(info.PieceLength)))
+	fmt.Printf("pieces:        %d\n", info.Pieces)
+	fmt.Printf("private:       %t\n", info.Private)
+	if info.CreatedBy != "" {
+		fmt.Printf("created by:    %s\n", info.CreatedBy)
+	}
+	if info.CreationDate != nil {
+		fmt.Printf("creation date: %s\n", info.CreationDate.Format(time.RFC1123))
+	}
+	if info.Comment != "" {
+		fmt.Printf("comment:       %s\n", info.Comment)
+	}
+
+	fmt.Println("trackers:")
+	for i, tier := range info.Trackers {
+		fmt.Printf("  tier %d: %s\n", i+1, strings.Join(tier, ", "))
+	}
+	if len(info.WebSeeds) > 0 {
+		fmt.Println("web seeds:")
+		for _, seed := range info.WebSeeds {
+			fmt.Printf("  %s\n", seed)
+		}
+	}
+	fmt.Println("files:")
+	if !multiFile {
+		fmt.Printf("  %s (%s)\n", info.Name, formatBytes(float64(info.Length)))
+		return
+	}
+	fmt.Printf("  %s/\n", info.Name)
+	files := append([]fileDetail(nil), info.Files...)
+	sort.SliceStable(files, func(i, j int) bool {
+		return strings.Join(files[i].Path, "/") < strings.Join(files[j].Path, "/")
+	})
+	printTree(files, 0, 4)
+}
+
+// Helper function to print files that are sorted by path as a tree, where the files share their first
+// depth parts
+func printTree(files []fileDetail, depth int, indent int) {
+	for i := 0; i < len(files); {
+		name := files[i].Path[depth]
+		if len(files[i].Path) == depth+1 {
+			fmt.Printf("%s%s (%s)\n", strings.Repeat(" ", indent), name, formatBytes(float64(files[i].Length)))
+			i++
+			continue
+		}
+		// Every following file in the same directory is printed within it
+		j := i + 1
+		for j < len(files) && len(files[j].Path) > depth+1 && files[j].Path[depth] == name {
+			j++
+		}
+		fmt.Printf("%s%s/\n", strings.Repeat(" ", indent), name)
+		printTree(files[i:j], depth+1, indent+2)
+		i = j
+	}
+}
+
+// Helper function to convert decoded bencode into values that can be written as JSON, where strings that
+// are not printable UTF-8 such as piece hashes are written as hex
+func rawJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return rawString(v)
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i := range v {
+			res[i] = rawJSON(v[i])
+		}
+		return res
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			res[rawString(key)] = rawJSON(val)
+		}
+		return res
+	}
+	return value
+}
+
+// Helper function to write a string as is when it is printable UTF-8 and as hex otherwise
+func rawString(s string) string {
+	if utf8.ValidString(s) && !strings.ContainsFunc(s, func(r rune) bool { return r < ' ' && r != '\n' && r != '\t' }) {
+		return s
+	}
+	return "hex:" + hex.EncodeToString([]byte(s))
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/faisal-fawad/vistorrent/torrent"
+)
+
+// Helper function to run a command while capturing what it prints to stdout
+func captureStdout(t *testing.T, command func() int) (string, int) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	status := command()
+	os.Stdout = stdout
+	w.Close()
+	out, _ := io.ReadAll(r)
+	return string(out), status
+}
+
+func TestInfoCommand(t *testing.T) {
+	dir := t.TempDir()
+	single := filepath.Join(dir, "single")
+	os.WriteFile(single, make([]byte, 40000), 0644)
+	multi := filepath.Join(dir, "multi")
+	os.MkdirAll(filepath.Join(multi, "a", "d"), 0755)
+	os.WriteFile(filepath.Join(multi, "b.txt"), make([]byte, 100), 0644)
+	os.WriteFile(filepath.Join(multi, "a", "c.txt"), make([]byte, 2048), 0644)
+	os.WriteFile(filepath.Join(multi, "a", "d", "e.txt"), make([]byte, 5), 0644)
+
+	tests := []struct {
+		name   string
+		path   string
+		files  []fileDetail
+		length uint32
+		pieces int
+		tree   string // The lines following files: in the output
+	}{
+		{"single file", single, []fileDetail{{[]string{"single"}, 40000}}, 40000, 3, "  single (39.1 KiB)\n"},
+		{"multi file", multi, []fileDetail{
+			{[]string{"a", "c.txt"}, 2048},
+			{[]string{"a", "d", "e.txt"}, 5},
+			{[]string{"b.txt"}, 100},
+		}, 2153, 1, "  multi/\n    a/\n      c.txt (2.0 KiB)\n      d/\n        e.txt (5.0 B)\n    b.txt (100.0 B)\n"},
+	}
+	for _, test := range tests {
+		bencode, err := torrent.Create(torrent.CreateOptions{
+			Path:        test.path,
+			PieceLength: 16384,
+			Announce:    "http://example.com/announce",
+			URLList:     []string{"http://example.com/seed"},
+			Comment:     "a comment",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := test.path + ".torrent"
+		os.WriteFile(path, bencode, 0644)
+		torr, err := torrent.ParseTorrent(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		infoHash := hex.EncodeToString(torr.InfoHash)
+
+		// The metainfo as JSON
+		out, status := captureStdout(t, func() int { return infoCommand([]string{"--json", path}) })
+		if status != 0 {
+			t.Fatalf("%s: expected: status %d -> got: %d", test.name, 0, status)
+		}
+		var info torrentInfo
+		if err := json.Unmarshal([]byte(out), &info); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if info.Name != filepath.Base(test.path) || info.InfoHash != infoHash || info.Version != "v1" {
+			t.Errorf("%s: expected: %s %s v1 -> got: %s %s %s", test.name, filepath.Base(test.path), infoHash, info.Name, info.InfoHash, info.Version)
+		}
+		if info.Length != test.length || info.PieceLength != 16384 || info.Pieces != test.pieces {
+			t.Errorf("%s: expected: %d %d %d -> got: %d %d %d", test.name, test.length, 16384, test.pieces, info.Length, info.PieceLength, info.Pieces)
+		}
+		if info.Comment != "a comment" || !reflect.DeepEqual(info.Trackers, [][]string{{"http://example.com/announce"}}) || !reflect.DeepEqual(info.WebSeeds, []string{"http://example.com/seed"}) {
+			t.Errorf("%s: expected: comment, tracker and web seed -> got: %q %v %v", test.name, info.Comment, info.Trackers, info.WebSeeds)
+		}
+		if !reflect.DeepEqual(info.Files, test.files) {
+			t.Errorf("%s: expected: %v -> got: %v", test.name, test.files, info.Files)
+		}
+
+		// The whole torrent file as JSON, where the piece hashes are written as hex
+		out, status = captureStdout(t, func() int { return infoCommand([]string{"--raw", path}) })
+		if status != 0 {
+			t.Fatalf("%s: expected: status %d -> got: %d", test.name, 0, status)
+		}
+		var raw map[string]interface{}
+		if err := json.Unmarshal([]byte(out), &raw); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		rawInfo, _ := raw["info"].(map[string]interface{})
+		if raw["announce"] != "http://example.com/announce" || rawInfo["name"] != filepath.Base(test.path) {
+			t.Errorf("%s: expected: announce and name -> got: %v %v", test.name, raw["announce"], rawInfo["name"])
+		}
+		if pieces, _ := rawInfo["pieces"].(string); pieces != "hex:"+hex.EncodeToString(bytes.Join(torr.PieceHashes, nil)) {
+			t.Errorf("%s: expected: hex pieces -> got: %s", test.name, pieces)
+		}
+		if _, ok := raw["info bencoded"]; ok {
+			t.Errorf("%s: expected: no info bencoded key", test.name)
+		}
+
+		// The metainfo for a person to read, ending in the file tree
+		out, status = captureStdout(t, func() int { return infoCommand([]string{path}) })
+		if status != 0 {
+			t.Fatalf("%s: expected: status %d -> got: %d", test.name, 0, status)
+		}
+		if !strings.Contains(out, "info hash:     "+infoHash+"\n") {
+			t.Errorf("%s: expected: info hash %s -> got: %s", test.name, infoHash, out)
+		}
+		if _, tree, _ := strings.Cut(out, "files:\n"); tree != test.tree {
+			t.Errorf("%s: expected: %q -> got: %q", test.name, test.tree, tree)
+		}
+	}
+}
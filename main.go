@@ -2,31 +2,51 @@ package main
 
 import (
 	"fmt"
-	"net/http"
 	"os"
-
-	"github.com/faisal-fawad/vistorrent/torrent"
 )
 
-func downloadHandler(w http.ResponseWriter, r *http.Request) {
-	// Set headers (may want to change in a production environment)
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
+// A subcommand, which gets the arguments after its name and returns the exit status
+type command struct {
+	run     func(args []string) int
+	summary string
+}
 
-	// Start downloading file
-	torrent.DownloadFile(os.Args[1], os.Args[2], w)
-	os.Exit(0)
+var commands = map[string]command{
+	"download": {downloadCommand, "download a torrent while showing progress in the terminal"},
+	"seed":     {seedCommand, "check the data of a torrent and announce it to the tracker as complete"},
+	"info":     {infoCommand, "print what a torrent contains"},
+	"create":   {createCommand, "create a torrent from a file or directory"},
+	"verify":   {verifyCommand, "check data on disk against a torrent"},
+	"magnet":   {magnetCommand, "print the magnet link of a torrent"},
+	"scrape":   {scrapeCommand, "ask the tracker of a torrent how many peers it has"},
+	"serve":    {serveCommand, "run a daemon controlled by a web page and JSON API"},
+}
+
+// The order that commands are listed in
+var commandOrder = []string{"download", "seed", "info", "create", "verify", "magnet", "scrape", "serve"}
+
+// Helper function to print every command
+func usage() {
+	fmt.Fprintln(os.Stderr, "invoke this program by using: ./vistorrent <command> [flags] [arguments]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	for _, name := range commandOrder {
+		fmt.Fprintf(os.Stderr, "  %-9s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintln(os.Stderr, "\nrun ./vistorrent <command> -h for the flags of a command")
 }
 
 func main() {
-	if len(os.Args[1:]) != 2 {
-		fmt.Println("invoke this command by using: ./vistorrent <input:file> <output:file>")
-		return
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		if os.Args[1] != "-h" && os.Args[1] != "--help" && os.Args[1] != "help" {
+			fmt.Fprintf(os.Stderr, "unknown command: %s\n\n", os.Args[1])
+		}
+		usage()
+		os.Exit(2)
 	}
-	fmt.Println("serving on http://localhost:8080")
-	http.Handle("/", http.FileServer(http.Dir("frontend")))
-	http.HandleFunc("/download", downloadHandler)
-	http.ListenAndServe(":8080", nil)
+	os.Exit(cmd.run(os.Args[2:]))
 }
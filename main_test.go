@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/faisal-fawad/vistorrent/torrent"
+)
+
+func TestParseTOML(t *testing.T) {
+	text := `# A comment on its own line
+destination = "/data/torrents" # A comment after a value
+peer_id_prefix = '-XX\n-'
+"log_level" = "de\"bug!"
+port = 6_881
+http_port = 0680
+masks = [0x1F, 0o17, 0b101, -12, +3]
+blocked = false
+schedule = [
+	"weekdays 09:00-17:00=512/64", # Rules may span lines
+	'00:00-06:00=0/0',
+]
+empty = []
+`
+	got, err := parseTOML(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"destination":    "/data/torrents",
+		"peer_id_prefix": `-XX\n-`, // Literal strings have no escapes
+		"log_level":      `de"bug!`,
+		"port":           int64(6881),
+		"http_port":      int64(680), // Leading zeros are not octal
+		"masks":          []interface{}{int64(31), int64(15), int64(5), int64(-12), int64(3)},
+		"blocked":        false,
+		"schedule":       []interface{}{"weekdays 09:00-17:00=512/64", "00:00-06:00=0/0"},
+		"empty":          []interface{}{},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected: %v -> got: %v", want, got)
+	}
+
+	errors := []string{
+		"[table]\nport = 1",
+		"port 1",
+		"port = 1 2",
+		"port = 1\nport = 2",
+		`destination = "unterminated`,
+		`destination = "bad \q escape"`,
+		"schedule = [1 2]",
+		"port = nope",
+		"port = 0x-1",
+		"port = 0b102",
+		"port = 0o",
+		"= 1",
+	}
+	for _, text := range errors {
+		if _, err := parseTOML(text); err == nil {
+			t.Errorf("expected error for %q", text)
+		}
+	}
+}
+
+func TestConfigPath(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--config", "a.toml", "file.torrent"}, "a.toml"},
+		{[]string{"-config=b.json"}, "b.json"},
+		{[]string{"-o", "dir", "file.torrent"}, ""},
+		{[]string{"--", "--config", "c.toml"}, ""},
+		{[]string{"--config"}, ""},
+	}
+	for _, test := range tests {
+		if got := configPath(test.args); got != test.want {
+			t.Errorf("%v: expected: %q -> got: %q", test.args, test.want, got)
+		}
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	// The config file in the user config directory is read when no path is given
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	os.MkdirAll(filepath.Join(dir, "vistorrent"), 0755)
+	err := os.WriteFile(filepath.Join(dir, "vistorrent", "config.toml"), []byte("port = 7000\nhttp_port = 9000\nschedule = ['00:00-06:00=0/0']\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags, cfg, err := commandFlags("download", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags.Parse(nil)
+	if cfg.Port != 7000 || cfg.HTTPPort != 9000 || cfg.LogLevel != "info" {
+		t.Errorf("expected the file over the defaults -> got: %+v", cfg)
+	}
+
+	// Flags override the file, and a list flag replaces the list of the file rather than adding to it
+	args := []string{"--port", "7001", "--schedule", "01:00-02:00=1/1", "--schedule", "03:00-04:00=1/1"}
+	flags, cfg, err = commandFlags("download", args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags.Parse(args)
+	if cfg.Port != 7001 || cfg.HTTPPort != 9000 || !reflect.DeepEqual(cfg.Schedule, []string{"01:00-02:00=1/1", "03:00-04:00=1/1"}) {
+		t.Errorf("expected flags over the file -> got: %+v", cfg)
+	}
+
+	// A file given with --config replaces the one in the user config directory, and unknown keys are errors
+	path := filepath.Join(dir, "other.json")
+	os.WriteFile(path, []byte(`{"port": 7002}`), 0644)
+	_, cfg, err = commandFlags("download", []string{"--config", path})
+	if err != nil || cfg.Port != 7002 || cfg.HTTPPort != 8080 {
+		t.Errorf("expected the given file -> got: %+v (%v)", cfg, err)
+	}
+	os.WriteFile(path, []byte(`{"prot": 7002}`), 0644)
+	if _, _, err = commandFlags("download", []string{"--config", path}); err == nil {
+		t.Errorf("expected error for unknown key")
+	}
+}
+
+func TestConfigApply(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Every session gets its own limits and timeouts, so that two sessions never change each other
+	var sessions []torrent.SessionOptions
+	for _, args := range [][]string{{"--download-limit", "10", "--handshake-timeout", "1s"}, {"--download-limit", "20", "--log-level", "debug"}} {
+		flags, cfg, err := commandFlags("download", args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		flags.Parse(args)
+		opts, _, err := cfg.apply(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessions = append(sessions, opts)
+	}
+	first, second := sessions[0], sessions[1]
+	if first.Limits == second.Limits || first.Limits.Download.Rate() != 10*1024 || second.Limits.Download.Rate() != 20*1024 {
+		t.Errorf("expected: separate limits -> got: %d and %d", first.Limits.Download.Rate(), second.Limits.Download.Rate())
+	}
+	if first.HandshakeTimeout != time.Second || second.HandshakeTimeout != torrent.DefaultHandshakeTimeout {
+		t.Errorf("expected: separate handshake timeouts -> got: %v and %v", first.HandshakeTimeout, second.HandshakeTimeout)
+	}
+	if first.Output != io.Discard || second.Output != os.Stderr {
+		t.Errorf("expected: output to follow the log level")
+	}
+}
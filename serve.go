@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/faisal-fawad/vistorrent/torrent"
+)
+
+// Runs a session along with the web page and the JSON API that control it until it is interrupted, where
+// any torrents given are added once it starts. The exit status is 0 once interrupted, 1 if the server
+// fails and 2 on invalid input
+func serveCommand(args []string) int {
+	flags, cfg, err := commandFlags("serve", args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "invoke this command by using: ./vistorrent serve [flags] [<input:file>...]")
+		flags.PrintDefaults()
+	}
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		return 2
+	}
+	var torrents []torrent.Torrent
+	var files [][]torrent.Priority
+	for _, name := range positional {
+		torr, err := torrent.ParseTorrent(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, name+":", err)
+			return 2
+		}
+		priorities, err := onlyFiles(torr, cfg.Only)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, name+":", err)
+			return 2
+		}
+		torrents = append(torrents, torr)
+		files = append(files, priorities)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	opts, sched, err := cfg.apply(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	session := torrent.NewSession(opts)
+	defer session.Close()
+	err = session.Listen()
+	if err != nil {
+		logInfo(err) // Peers can still be dialed without a listener
+	}
+	for i, torr := range torrents {
+		_, err := session.AddTorrent(torr, filepath.Join(cfg.Destination, torr.Name), torrent.TorrentOptions{FilePriorities: files[i]})
+		if err != nil {
+			logInfo(torr.Name+":", err)
+		}
+	}
+
+	addr := net.JoinHostPort(cfg.HTTPHost, strconv.Itoa(cfg.HTTPPort))
+	server := &http.Server{Addr: addr, Handler: newAPI(session, sched, cfg.Destination), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	logInfo("serving on http://" + addr)
+	err = server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// Helper function to stream the events of a download as server-sent events until the page is closed,
+// where the page first receives every piece that is already done
+func streamDownload(w http.ResponseWriter, r *http.Request, session *torrent.Session, download *torrent.Download) {
+	setEventHeaders(w)
+	events := session.Events().Subscribe(r.Context())
+	observer := sseObserver(w)
+	observer(download.StartedEvent())
+	pieces := download.Pieces()
+	done := 0
+	for i := range pieces {
+		if pieces[i] {
+			done++
+			observer(torrent.Event{Type: torrent.EventPieceCompleted, Torrent: download.ID(), Piece: i, Done: done, Total: len(pieces)})
+		}
+	}
+	for event := range events {
+		if event.Torrent == download.ID() {
+			observer(event)
+		}
+	}
+}
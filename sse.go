@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/faisal-fawad/vistorrent/torrent"
+)
+
+// Sets the headers of a stream of server-sent events (may want to change in a production environment)
+func setEventHeaders(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+}
+
+// Creates an observer which sends every event to a web page as a server-sent event of JSON, where the
+// type field tells events apart
+func sseObserver(w http.ResponseWriter) torrent.Observer {
+	var mutex sync.Mutex // Events may come from several goroutines
+	return func(event torrent.Event) {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package torrent
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Parses the attributes of a file, which are stored alongside its length and path
+// The format of the attributes can be found here:
+// https://www.bittorrent.org/beps/bep_0047.html
+func ParseAttributes(dict map[string]interface{}, file *File) error {
+	attr, _ := dict["attr"].(string)
+	file.Padding = strings.ContainsRune(attr, 'p')
+	file.Executable = strings.ContainsRune(attr, 'x')
+	file.Hidden = strings.ContainsRune(attr, 'h')
+
+	if strings.ContainsRune(attr, 'l') {
+		components, _ := dict["symlink path"].([]interface{})
+		if len(components) == 0 {
+			return &TorrentError{"symlink missing path"}
+		}
+		for i := range components {
+			component, _ := components[i].(string)
+			if !ValidPathComponent(component) {
+				return &TorrentError{"symlink has invalid path"}
+			}
+			file.SymlinkPath = append(file.SymlinkPath, component)
+		}
+	}
+
+	if sha1, ok := dict["sha1"].(string); ok {
+		if len(sha1) != hashLength {
+			return &TorrentError{"file has invalid sha1"}
+		}
+		file.SHA1 = []byte(sha1)
+	}
+	return nil
+}
+
+// Creates the symlinks of a torrent and sets the permissions of executable files, which should be
+// done once every piece is complete. Every symlink points within the download root, and skipped files
+// are left alone
+func (s *FileStorage) ApplyAttributes() error {
+	for i, file := range s.files {
+		if file.Padding || s.Skipped != nil && s.Skipped(i) {
+			continue
+		}
+		path := s.FilePath(i)
+
+		if file.SymlinkPath != nil {
+			root := s.root
+			if !s.multi {
+				root = filepath.Dir(s.root)
+			}
+			// Symlink paths are relative to the root, so they are made relative to the link itself
+			target, err := filepath.Rel(filepath.Dir(path), filepath.Join(append([]string{root}, file.SymlinkPath...)...))
+			if err != nil {
+				return err
+			}
+			err = os.MkdirAll(filepath.Dir(path), 0755)
+			if err != nil {
+				return err
+			}
+			err = os.Remove(path)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			err = os.Symlink(target, path)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if file.Executable {
+			err := os.Chmod(path, 0755)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package torrent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAttributes(t *testing.T) {
+	files, err := ParseFiles([]interface{}{
+		map[string]interface{}{"length": 3, "path": []interface{}{"run.sh"}, "attr": "x"},
+		map[string]interface{}{"length": 5, "path": []interface{}{".pad", "5"}, "attr": "p"},
+		map[string]interface{}{"length": 0, "path": []interface{}{"link"}, "attr": "l", "symlink path": []interface{}{"dir", "b"}},
+		map[string]interface{}{"length": 2, "path": []interface{}{"dir", "b"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !files[0].Executable || !files[1].Padding || files[2].SymlinkPath == nil {
+		t.Fatalf("unexpected attributes: %+v", files)
+	}
+
+	_, err = ParseFiles([]interface{}{
+		map[string]interface{}{"length": 0, "path": []interface{}{"link"}, "attr": "l", "symlink path": []interface{}{"..", "etc"}},
+	})
+	if err == nil {
+		t.Errorf("expected error for symlink outside of the download root")
+	}
+
+	root := t.TempDir()
+	storage := NewFileStorage(&Torrent{Files: files, MultiFile: true}, root)
+	defer storage.Close()
+
+	// Padding reads back as zeros and is never written to disk
+	storage.WriteAt([]byte("abcxxxxxde"), 0)
+	buf := make([]byte, 10)
+	storage.ReadAt(buf, 0)
+	if string(buf) != "abc\x00\x00\x00\x00\x00de" {
+		t.Errorf("expected: padding -> got: %q", buf)
+	}
+	if _, err := os.Stat(filepath.Join(root, ".pad")); err == nil {
+		t.Errorf("padding file was written to disk")
+	}
+
+	err = storage.ApplyAttributes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat, _ := os.Stat(filepath.Join(root, "run.sh")); stat.Mode()&0100 == 0 {
+		t.Errorf("expected executable file")
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "link")); string(data) != "de" {
+		t.Errorf("expected: symlink to %q -> got: %q", "de", data)
+	}
+}
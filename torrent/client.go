@@ -1,79 +1,47 @@
 package torrent
 
 import (
-	"crypto/rand"
+	"context"
 	"fmt"
-	"net/http"
-	"os"
-	"runtime"
-	"time"
+	"io"
 )
 
-type Work struct {
-	Index  int
-	Length int
+// A piece whose blocks have all been received, which is sent to the results queue once it is checked
+type Result struct {
+	Index   int
+	Result  []byte
+	Verdict Verdict
+	Banned  []string // Peers that were banned because of the piece
 }
 
-type Result struct {
-	Index  int
-	Result []byte
+// Options of a download, where every field may be left empty
+type DownloadOptions struct {
+	Filter   *IPFilter // Peers blocked by the filter are never connected to
+	Limits   *Limits   // Limits of this torrent, which apply along with the limits of the session
+	Strategy Strategy  // How pieces are picked, which defaults to rarest first
+	Output   io.Writer // Where the download prints what it is doing, which defaults to standard output
 }
 
-func DownloadFile(name string, destination string, w http.ResponseWriter) error {
+// Downloads a torrent to a destination, where every event of the download is delivered to the observer
+// Cancelling ctx stops the download and closes every connection before returning
+func DownloadFile(ctx context.Context, name string, destination string, opts DownloadOptions, observer Observer) error {
 	torr, err := ParseTorrent(name)
 	if err != nil {
 		return err
 	}
-
-	// Get peers by using a random peerId
-	peerId := make([]byte, peerIdSize)
-	rand.Read(peerId)
-	peers, err := torr.GetPeers(peerId)
+	session := NewSession(SessionOptions{Filter: opts.Filter, Output: opts.Output})
+	defer session.Close()
+	err = session.Listen()
 	if err != nil {
-		return err
-	}
-
-	// Make channels for each piece
-	workQueue := make(chan *Work, len(torr.PieceHashes))
-	resQueue := make(chan *Result)
-	for i := range torr.PieceHashes {
-		size := int(torr.PieceLength)
-		// Get size and reduce if necessary (can occur on last piece of data)
-		if int(torr.Length)-i*size < size {
-			size = int(torr.Length) - i*size
-		}
-		workQueue <- &Work{i, size}
+		fmt.Fprintln(session.opts.Output, err) // Peers can still be dialed without a listener
 	}
 
-	for i := range peers {
-		var peer Peer = peers[i]
-		go torr.PieceWorker(peer, peerId, workQueue, resQueue)
+	if observer != nil {
+		session.Events().Observe(observer)
 	}
-
-	// Send number of pieces to server
-	fmt.Fprintf(w, "data: %d \n\n", len(torr.PieceHashes))
-	w.(http.Flusher).Flush()
-	time.Sleep(1 * time.Second)
-	// For case study
-
-	done := 0
-	total := len(torr.PieceHashes)
-	file := make([]byte, torr.Length)
-	for done < total {
-		res := <-resQueue
-		bound := int(torr.PieceLength) * res.Index
-		copy(file[bound:bound+len(res.Result)], res.Result)
-		done++
-		fmt.Printf("Piece #%d complete (%d / %d) with %d peers \n", res.Index, done, total, runtime.NumGoroutine()-1)
-
-		// Send data to server
-		fmt.Fprintf(w, "data: %d \n\n", res.Index)
-		w.(http.Flusher).Flush()
-		// For case study
+	download, err := session.AddTorrent(torr, destination, TorrentOptions{opts.Limits, opts.Strategy, nil})
+	if err != nil {
+		return err
 	}
-	close(workQueue)
-	close(resQueue)
-
-	err = os.WriteFile(destination, file, 0644)
-	return err
+	return download.Wait(ctx)
 }
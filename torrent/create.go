@@ -0,0 +1,208 @@
+package torrent
+
+import (
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const minPieceLength uint32 = 1 << 14 // 16 KiB, the size of a single block
+const maxPieceLength uint32 = 1 << 24 // 16 MiB
+const targetPieces uint32 = 1500      // Automatic piece lengths aim for roughly this many pieces
+
+// Options for creating a torrent file, only Path and at least one tracker are required
+type CreateOptions struct {
+	Path         string     // A file or a directory
+	PieceLength  uint32     // Chosen automatically when zero
+	Announce     string     // Defaults to the first tracker of AnnounceList
+	AnnounceList [][]string // Tiers of trackers as per https://www.bittorrent.org/beps/bep_0012.html
+	URLList      []string   // Web seeds as per https://www.bittorrent.org/beps/bep_0019.html
+	Comment      string
+	CreatedBy    string
+	CreationDate time.Time // Omitted when zero
+	Private      bool
+}
+
+// Creates the contents of a torrent file by walking a file or directory and hashing its pieces concurrently
+func Create(opts CreateOptions) ([]byte, error) {
+	if opts.Announce == "" && len(opts.AnnounceList) > 0 && len(opts.AnnounceList[0]) > 0 {
+		opts.Announce = opts.AnnounceList[0][0]
+	}
+	if opts.Announce == "" {
+		return nil, &TorrentError{"at least one tracker is required"}
+	}
+
+	stat, err := os.Stat(opts.Path)
+	if err != nil {
+		return nil, &TorrentError{"failed to read path: " + err.Error()}
+	}
+	torr := Torrent{Name: filepath.Base(filepath.Clean(opts.Path)), MultiFile: stat.IsDir()}
+	torr.Files, err = WalkFiles(opts.Path, stat)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range torr.Files {
+		torr.Length += file.Length
+	}
+	if torr.Length == 0 {
+		return nil, &TorrentError{"cannot create a torrent with no data"}
+	}
+
+	torr.PieceLength = opts.PieceLength
+	if torr.PieceLength == 0 {
+		torr.PieceLength = ChoosePieceLength(torr.Length)
+	}
+	if torr.PieceLength < minPieceLength || torr.PieceLength&(torr.PieceLength-1) != 0 {
+		return nil, &TorrentError{"piece length must be a power of two of at least 16 KiB"}
+	}
+
+	pieces, err := torr.HashPieces(opts.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Build the info dictionary, which is all that the info hash covers
+	info := map[string]interface{}{
+		"name":         torr.Name,
+		"piece length": torr.PieceLength,
+		"pieces":       pieces,
+	}
+	if opts.Private {
+		info["private"] = 1
+	}
+	if torr.MultiFile {
+		files := make([]interface{}, 0, len(torr.Files))
+		for _, file := range torr.Files {
+			files = append(files, map[string]interface{}{"length": file.Length, "path": file.Path})
+		}
+		info["files"] = files
+	} else {
+		info["length"] = torr.Length
+	}
+
+	metainfo := map[string]interface{}{
+		"announce": opts.Announce,
+		"info":     info,
+	}
+	if len(opts.AnnounceList) > 0 {
+		tiers := make([]interface{}, 0, len(opts.AnnounceList))
+		for _, tier := range opts.AnnounceList {
+			tiers = append(tiers, tier)
+		}
+		metainfo["announce-list"] = tiers
+	}
+	if len(opts.URLList) > 0 {
+		metainfo["url-list"] = opts.URLList
+	}
+	if opts.Comment != "" {
+		metainfo["comment"] = opts.Comment
+	}
+	if opts.CreatedBy != "" {
+		metainfo["created by"] = opts.CreatedBy
+	}
+	if !opts.CreationDate.IsZero() {
+		metainfo["creation date"] = opts.CreationDate.Unix()
+	}
+
+	bencode, err := EncodeBencode(metainfo)
+	if err != nil {
+		return nil, &TorrentError{err.Error()}
+	}
+	return []byte(bencode), nil
+}
+
+// Gets the files within a path in lexical order, a single file is returned as is
+func WalkFiles(path string, stat fs.FileInfo) ([]File, error) {
+	if !stat.IsDir() {
+		if stat.Size() > math.MaxUint32 {
+			return []File{}, &TorrentError{"only support torrents smaller than 4 GiB"}
+		}
+		return []File{{Path: []string{stat.Name()}, Length: uint32(stat.Size())}}, nil
+	}
+
+	var files []File
+	var offset uint64
+	err := filepath.WalkDir(path, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Directories are implied by the paths of files and anything other than a regular file is skipped
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(path, name)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, File{Path: strings.Split(filepath.ToSlash(relative), "/"), Length: uint32(info.Size()), Offset: uint32(offset)})
+		offset += uint64(info.Size())
+		if offset > math.MaxUint32 {
+			return &TorrentError{"only support torrents smaller than 4 GiB"}
+		}
+		return nil
+	})
+	if err != nil {
+		return []File{}, &TorrentError{"failed to walk path: " + err.Error()}
+	}
+	if len(files) == 0 {
+		return []File{}, &TorrentError{"directory contains no files"}
+	}
+
+	return files, nil
+}
+
+// Chooses the smallest power of two piece length which results in roughly the target number of pieces
+func ChoosePieceLength(length uint32) uint32 {
+	pieceLength := minPieceLength
+	for pieceLength < maxPieceLength && length/pieceLength > targetPieces {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// Helper function to hash every piece of the data at a path in parallel, returning the concatenated hashes
+func (t *Torrent) HashPieces(path string) (string, error) {
+	count := (int(t.Length) + int(t.PieceLength) - 1) / int(t.PieceLength)
+	hashes := make([]byte, count*hashLength)
+	storage := NewFileStorage(t, path)
+	defer storage.Close()
+
+	indices := make(chan int, count)
+	for i := range count {
+		indices <- i
+	}
+	close(indices)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var failed error
+	for range runtime.NumCPU() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			piece := make([]byte, t.PieceLength)
+			for i := range indices {
+				size := t.PieceSize(i)
+				_, err := storage.ReadAt(piece[:size], int64(t.PieceLength)*int64(i))
+				if err != nil {
+					once.Do(func() { failed = &TorrentError{"failed to read piece: " + err.Error()} })
+					return
+				}
+				copy(hashes[i*hashLength:], GetHash(piece[:size]))
+			}
+		}()
+	}
+	wg.Wait()
+
+	return string(hashes), failed
+}
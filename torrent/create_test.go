@@ -0,0 +1,76 @@
+package torrent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncodeBencode(t *testing.T) {
+	for _, test := range allTests {
+		if test.expected == "" {
+			continue // Only valid bencode can be encoded
+		}
+		if dict, ok := test.expected.(map[string]interface{}); ok && dict["info bencoded"] != nil {
+			continue // Contains a key that only exists after decoding
+		}
+		got, err := EncodeBencode(test.expected)
+		if err != nil || got != test.bencode {
+			t.Errorf("expected: %q -> got: %q (%v)", test.bencode, got, err)
+		}
+	}
+}
+
+func TestCreate(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "root")
+	os.MkdirAll(filepath.Join(root, "dir"), 0755)
+	os.WriteFile(filepath.Join(root, "a.txt"), []byte(strings.Repeat("a", 20000)), 0644)
+	os.WriteFile(filepath.Join(root, "dir", "b.txt"), []byte(strings.Repeat("b", 30000)), 0644)
+
+	bencode, err := Create(CreateOptions{
+		Path:         root,
+		AnnounceList: [][]string{{"http://example.com/announce"}, {"http://backup.example.com/announce"}},
+		URLList:      []string{"http://seed.example.com/"},
+		Comment:      "test",
+		CreatedBy:    "vistorrent",
+		CreationDate: time.Unix(1700000000, 0),
+		Private:      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	torr, err := ParseMetainfo(bencode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if torr.Announce != "http://example.com/announce" || torr.Name != "root" || !torr.MultiFile || torr.Length != 50000 {
+		t.Errorf("unexpected torrent: %+v", torr)
+	}
+	if len(torr.AnnounceList) != 2 || torr.AnnounceList[1][0] != "http://backup.example.com/announce" ||
+		!reflect.DeepEqual(torr.URLList, []string{"http://seed.example.com/"}) || torr.Comment != "test" ||
+		torr.CreatedBy != "vistorrent" || torr.CreationDate.Unix() != 1700000000 || !torr.Private {
+		t.Errorf("unexpected metadata: %+v", torr)
+	}
+	expected := []File{{Path: []string{"a.txt"}, Length: 20000, Offset: 0}, {Path: []string{"dir", "b.txt"}, Length: 30000, Offset: 20000}}
+	if !reflect.DeepEqual(torr.Files, expected) {
+		t.Errorf("expected: %v -> got: %v", expected, torr.Files)
+	}
+
+	// The info hash must survive a decode and encode of the info dictionary
+	res, _, _ := DecodeBencode(string(bencode))
+	info, _ := EncodeBencode(res.(map[string]interface{})["info"])
+	if !reflect.DeepEqual(GetHash([]byte(info)), torr.InfoHash) {
+		t.Errorf("info hash does not round-trip")
+	}
+
+	storage := NewFileStorage(&torr, root)
+	defer storage.Close()
+	if res, err := torr.Verify(context.Background(), storage); err != nil || !res.Complete() {
+		t.Errorf("created torrent does not verify against its own data")
+	}
+}
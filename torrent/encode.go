@@ -0,0 +1,71 @@
+package torrent
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Encodes a value into its bencode string, the inverse of DecodeBencode. Dictionary keys are
+// sorted as required by the specification, so the output is canonical and safe to hash
+func EncodeBencode(value interface{}) (string, error) {
+	var builder strings.Builder
+	err := encodeBencode(&builder, value)
+	if err != nil {
+		return "", err
+	}
+	return builder.String(), nil
+}
+
+// Helper function to recursively encode a value
+func encodeBencode(builder *strings.Builder, value interface{}) error {
+	switch v := value.(type) {
+	case string:
+		builder.WriteString(strconv.Itoa(len(v)))
+		builder.WriteByte(':')
+		builder.WriteString(v)
+	case []byte:
+		return encodeBencode(builder, string(v))
+	case int:
+		builder.WriteString("i" + strconv.Itoa(v) + "e")
+	case int64:
+		builder.WriteString("i" + strconv.FormatInt(v, 10) + "e")
+	case uint32:
+		builder.WriteString("i" + strconv.FormatUint(uint64(v), 10) + "e")
+	case []string:
+		builder.WriteByte('l')
+		for i := range v {
+			encodeBencode(builder, v[i])
+		}
+		builder.WriteByte('e')
+	case []interface{}:
+		builder.WriteByte('l')
+		for i := range v {
+			err := encodeBencode(builder, v[i])
+			if err != nil {
+				return err
+			}
+		}
+		builder.WriteByte('e')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		builder.WriteByte('d')
+		for _, key := range keys {
+			encodeBencode(builder, key)
+			err := encodeBencode(builder, v[key])
+			if err != nil {
+				return err
+			}
+		}
+		builder.WriteByte('e')
+	default:
+		return fmt.Errorf("cannot encode %T as bencode", value)
+	}
+	return nil
+}
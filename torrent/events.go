@@ -0,0 +1,181 @@
+package torrent
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// The type of an event
+type EventType string
+
+const (
+	EventStarted          EventType = "started"           // A torrent was added, with its name, size and number of pieces
+	EventPieceRequested   EventType = "piece_requested"   // A peer was asked for the first block of a piece it did not have yet
+	EventBlockReceived    EventType = "block_received"    // A peer sent a block that we requested
+	EventPieceCompleted   EventType = "piece_completed"   // A piece is valid and written, with the peers that sent it if any
+	EventHashFailed       EventType = "hash_failed"       // A piece did not match its hash, with the peers that sent it
+	EventPeerConnected    EventType = "peer_connected"    // A peer finished the handshake
+	EventPeerStats        EventType = "peer_stats"        // The client name and rates of a peer, sent every few seconds
+	EventPeerDisconnected EventType = "peer_disconnected" // A connected peer went away, with the reason if any
+	EventPeerBanned       EventType = "peer_banned"       // A peer was banned for sending bad data
+	EventAnnounce         EventType = "announce"          // The tracker was asked for peers, with the number of peers
+	EventFinished         EventType = "finished"          // Every piece of a torrent is done
+	EventError            EventType = "error"             // A torrent failed
+)
+
+// Something that happened to a torrent, where only the fields that apply to its type are set. Peer is the
+// address of a connection while Peers are the addresses without ports that sent the blocks of a piece
+type Event struct {
+	Type         EventType
+	Torrent      string // The id of the torrent
+	Time         time.Time
+	Name         string
+	Length       int64 // Number of bytes of the torrent
+	PieceLength  int
+	Piece        int
+	Begin        int // Offset of a block within its piece
+	BlockLength  int
+	Done         int // Number of pieces that are done
+	Total        int // Number of pieces
+	Peer         string
+	Peers        []string
+	Client       string // The client name a peer sent in its extended handshake
+	DownloadRate int    // Bytes per second received from a peer
+	UploadRate   int    // Bytes per second sent to a peer
+	Found        int    // Number of peers the tracker returned
+	Err          error
+}
+
+// Encodes an event as a JSON object with a type field and the fields that apply to its type
+func (e Event) MarshalJSON() ([]byte, error) {
+	res := map[string]interface{}{"type": e.Type, "torrent": e.Torrent, "time": e.Time}
+	switch e.Type {
+	case EventStarted:
+		res["name"], res["length"], res["piece_length"], res["total"] = e.Name, e.Length, e.PieceLength, e.Total
+	case EventPieceRequested:
+		res["piece"], res["peer"] = e.Piece, e.Peer
+	case EventBlockReceived:
+		res["piece"], res["peer"], res["begin"], res["length"] = e.Piece, e.Peer, e.Begin, e.BlockLength
+	case EventPieceCompleted:
+		res["piece"], res["done"], res["total"], res["peers"] = e.Piece, e.Done, e.Total, e.Peers
+	case EventHashFailed:
+		res["piece"], res["peers"] = e.Piece, e.Peers
+	case EventPeerConnected, EventPeerDisconnected:
+		res["peer"] = e.Peer
+	case EventPeerStats:
+		res["peer"], res["client"], res["download_rate"], res["upload_rate"] = e.Peer, e.Client, e.DownloadRate, e.UploadRate
+	case EventPeerBanned:
+		res["peer"], res["piece"] = e.Peer, e.Piece
+	case EventAnnounce:
+		res["found"] = e.Found
+	}
+	if e.Err != nil {
+		res["error"] = e.Err.Error()
+	}
+	return json.Marshal(res)
+}
+
+// A function that is called for every event, which must return quickly since it is called by the
+// goroutine that caused the event
+type Observer func(event Event)
+
+// Delivers events to observers, which may subscribe at any time. It is safe for concurrent use
+type Events struct {
+	mutex     sync.Mutex
+	observers map[int]Observer
+	next      int
+}
+
+// Creates events without any observers
+func NewEvents() *Events {
+	return &Events{observers: make(map[int]Observer)}
+}
+
+// Calls an observer for every later event until the returned function is called
+func (e *Events) Observe(observer Observer) func() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	id := e.next
+	e.next++
+	e.observers[id] = observer
+	return func() {
+		e.mutex.Lock()
+		defer e.mutex.Unlock()
+		delete(e.observers, id)
+	}
+}
+
+const lossyQueue = 4096  // Events queued for a slow reader before block and peer stats events are dropped
+const maxQueue = 1 << 16 // Events queued for a reader that stopped reading before it is closed
+
+// Delivers every later event through a channel until ctx is cancelled, after which the channel is
+// closed. Events are queued for a slow reader rather than holding up the download, but once the reader
+// falls behind, events about single blocks and peer rates are dropped since later events replace them.
+// A reader that falls even further behind has its channel closed before ctx is cancelled
+func (e *Events) Subscribe(ctx context.Context) <-chan Event {
+	var mutex sync.Mutex
+	var queue []Event
+	overflowed := false
+	notify := make(chan struct{}, 1)
+	stop := e.Observe(func(event Event) {
+		mutex.Lock()
+		switch {
+		case overflowed:
+		case len(queue) >= maxQueue:
+			overflowed = true
+			queue = nil
+		case len(queue) >= lossyQueue && (event.Type == EventBlockReceived || event.Type == EventPeerStats):
+		default:
+			queue = append(queue, event)
+		}
+		mutex.Unlock()
+		select {
+		case notify <- struct{}{}:
+		default:
+		}
+	})
+
+	out := make(chan Event)
+	go func() {
+		defer close(out)
+		defer stop()
+		for {
+			mutex.Lock()
+			pending := queue
+			queue = nil
+			closed := overflowed
+			mutex.Unlock()
+			if closed {
+				return
+			}
+			for _, event := range pending {
+				select {
+				case out <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-notify:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// Delivers an event to every observer
+func (e *Events) Emit(event Event) {
+	e.mutex.Lock()
+	observers := make([]Observer, 0, len(e.observers))
+	for _, observer := range e.observers {
+		observers = append(observers, observer)
+	}
+	e.mutex.Unlock()
+	for _, observer := range observers {
+		observer(event)
+	}
+}
@@ -0,0 +1,99 @@
+package torrent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestEvents(t *testing.T) {
+	events := NewEvents()
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := events.Subscribe(ctx)
+	observed := 0
+	stop := events.Observe(func(Event) { observed++ })
+
+	// Events are queued in order for a subscriber that is not reading yet
+	for i := range 100 {
+		events.Emit(Event{Type: EventPieceCompleted, Piece: i})
+	}
+	for i := range 100 {
+		if event := <-stream; event.Piece != i {
+			t.Fatalf("expected: piece %d -> got: %d", i, event.Piece)
+		}
+	}
+
+	// Observers stop receiving events once they unsubscribe, and streams close once cancelled
+	stop()
+	events.Emit(Event{Type: EventFinished})
+	if observed != 100 {
+		t.Errorf("expected: %d events -> got: %d", 100, observed)
+	}
+	cancel()
+	for range stream {
+	}
+}
+
+func TestEventsSlowReader(t *testing.T) {
+	events := NewEvents()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := events.Subscribe(ctx)
+
+	// Once the queue is long enough, block events are dropped while other events are still queued. The
+	// events that are being delivered are no longer queued, so up to twice as many may arrive
+	for range 3 * lossyQueue {
+		events.Emit(Event{Type: EventBlockReceived})
+	}
+	events.Emit(Event{Type: EventPieceCompleted})
+	blocks := 0
+	for event := range stream {
+		if event.Type == EventPieceCompleted {
+			break
+		}
+		blocks++
+	}
+	if blocks < lossyQueue || blocks > 2*lossyQueue {
+		t.Errorf("expected: %d to %d blocks -> got: %d", lossyQueue, 2*lossyQueue, blocks)
+	}
+
+	// A reader that falls too far behind is closed
+	slow := events.Subscribe(ctx)
+	for range 2*maxQueue + 1 {
+		events.Emit(Event{Type: EventPieceCompleted})
+	}
+	for range slow {
+	}
+	if ctx.Err() != nil {
+		t.Errorf("expected the stream to close before it was cancelled")
+	}
+}
+
+func TestEventJSON(t *testing.T) {
+	tests := []struct {
+		event Event
+		want  map[string]interface{}
+	}{
+		{Event{Type: EventPieceCompleted, Piece: 0, Done: 1, Total: 2, Peers: []string{"1.2.3.4"}, Peer: "unused"},
+			map[string]interface{}{"type": "piece_completed", "piece": 0.0, "done": 1.0, "total": 2.0, "peers": []interface{}{"1.2.3.4"}}},
+		{Event{Type: EventPeerStats, Peer: "1.2.3.4:5", Client: "test", DownloadRate: 10},
+			map[string]interface{}{"type": "peer_stats", "peer": "1.2.3.4:5", "client": "test", "download_rate": 10.0, "upload_rate": 0.0}},
+		{Event{Type: EventError, Err: errors.New("failed")},
+			map[string]interface{}{"type": "error", "error": "failed"}},
+	}
+	for _, test := range tests {
+		out, err := json.Marshal(test.event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got map[string]interface{}
+		json.Unmarshal(out, &got)
+		delete(got, "time")
+		delete(got, "torrent")
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("expected: %v -> got: %v", test.want, got)
+		}
+	}
+}
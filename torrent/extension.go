@@ -0,0 +1,66 @@
+package torrent
+
+import (
+	"fmt"
+)
+
+const Extended byte = 20         // Payload contains an extended message id followed by its payload
+const extendedHandshake byte = 0 // The extended message id of the extended handshake
+const extensionByte int = 5      // The reserved byte of a handshake that holds the extension protocol bit
+const extensionBit byte = 0x10   // The bit that signals support for the extension protocol
+const clientName = "vistorrent"  // Sent to peers so that they know which client we are
+const defaultReqq int = 250      // The number of requests a peer allows when it does not advertise reqq
+
+// The extended handshake of a peer, which is sent once after the handshake when both peers support
+// the extension protocol. The format of the extension protocol can be found here:
+// https://www.bittorrent.org/beps/bep_0010.html
+type ExtensionHandshake struct {
+	Messages     map[string]int // Extended message ids of the extensions a peer supports
+	Reqq         int            // Number of outstanding requests a peer allows
+	Client       string
+	MetadataSize int // Size of the info dictionary, which peers that support ut_metadata send
+}
+
+// Checks whether the reserved bytes of a handshake signal support for the extension protocol
+func SupportsExtensions(extensions []byte) bool {
+	return len(extensions) == extensionSize && extensions[extensionByte]&extensionBit != 0
+}
+
+// Builds our extended handshake message
+func BuildExtendedHandshake() Message {
+	bencode, _ := EncodeBencode(map[string]interface{}{
+		"m": map[string]interface{}{},
+		"v": clientName,
+	})
+	payload := append([]byte{extendedHandshake}, bencode...)
+	return Message{uint32(len(payload) + 1), Extended, payload}
+}
+
+// Parses the payload of an extended handshake message into a structure
+func ParseExtendedHandshake(payload []byte) (ExtensionHandshake, error) {
+	if len(payload) < 2 || payload[0] != extendedHandshake {
+		return ExtensionHandshake{}, fmt.Errorf("error parsing extended handshake: not a handshake")
+	}
+	res, _, err := DecodeBencode(string(payload[1:]))
+	if err != nil {
+		return ExtensionHandshake{}, err
+	}
+	dict, ok := res.(map[string]interface{})
+	if !ok {
+		return ExtensionHandshake{}, &DecodeError{"handshake not dictionary"}
+	}
+
+	h := ExtensionHandshake{Messages: make(map[string]int), Reqq: defaultReqq}
+	messages, _ := dict["m"].(map[string]interface{})
+	for name, id := range messages {
+		if id, ok := id.(int); ok && id > 0 {
+			h.Messages[name] = id
+		}
+	}
+	if reqq, ok := dict["reqq"].(int); ok && reqq > 0 {
+		h.Reqq = reqq
+	}
+	h.Client, _ = dict["v"].(string)
+	h.MetadataSize, _ = dict["metadata_size"].(int)
+	return h, nil
+}
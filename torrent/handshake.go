@@ -1,6 +1,8 @@
 package torrent
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -11,12 +13,15 @@ import (
 const extensionSize int = 8 // 8 bytes which represents the enabled extensions on our client
 const peerIdSize int = 20   // The ID of a peer is 20 bytes
 
+// Max time to connect to a peer and exchange handshakes unless a session is given another
+const DefaultHandshakeTimeout = 3 * time.Second
+
 type Handshake struct {
 	ProtocolLength byte
 	Protocol       string
 	Extensions     []byte
-	PeerId         []byte
 	InfoHash       []byte
+	PeerId         []byte
 }
 
 // Builds a []byte representation of a handshake
@@ -25,8 +30,8 @@ func (h *Handshake) BuildHandshake() []byte {
 	res = append(res, h.ProtocolLength)
 	res = append(res, []byte(h.Protocol)...)
 	res = append(res, h.Extensions...)
-	res = append(res, h.PeerId...)
 	res = append(res, h.InfoHash...)
+	res = append(res, h.PeerId...)
 	return res
 }
 
@@ -42,48 +47,77 @@ func ParseHandshake(stream []byte) (Handshake, error) {
 	h.ProtocolLength = length
 	h.Protocol = string(stream[1 : length+1])
 	h.Extensions = stream[length+1 : int(length)+extensionSize+1]
-	h.PeerId = stream[int(length)+extensionSize+1 : int(length)+extensionSize+peerIdSize+1]
-	h.InfoHash = stream[int(length)+extensionSize+peerIdSize+1:]
+	h.InfoHash = stream[int(length)+extensionSize+1 : int(length)+extensionSize+hashLength+1]
+	h.PeerId = stream[int(length)+extensionSize+hashLength+1:]
 
 	return h, nil
 }
 
-func (peer Peer) PeerHandshake(infoHash []byte, peerId []byte) (net.Conn, Handshake, error) {
-	conn, err := net.DialTimeout("tcp", peer.String(), 3*time.Second) // 3 second timeout
+// Connects to a peer and does the handshake, which is abandoned once ctx is cancelled or after timeout
+func (peer Peer) PeerHandshake(ctx context.Context, infoHash []byte, peerId []byte, timeout time.Duration) (net.Conn, Handshake, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", peer.String())
 	if err != nil {
 		return nil, Handshake{}, &NetworkError{"failed to connect to peer"}
 	}
-	conn.SetDeadline(time.Now().Add(time.Second * 3))
+	conn.SetDeadline(time.Now().Add(timeout))
 	defer conn.SetDeadline(time.Time{}) // Want to keep our connection on success
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	err = SendHandshake(conn, infoHash, peerId)
+	if err != nil {
+		conn.Close()
+		return nil, Handshake{}, err
+	}
+	outHand, err := ReadHandshake(conn)
+	if err != nil {
+		conn.Close()
+		return nil, Handshake{}, err
+	}
+	if !bytes.Equal(outHand.InfoHash, infoHash) {
+		conn.Close()
+		return nil, Handshake{}, &NetworkError{"peer responded with a different info hash"}
+	}
+
+	return conn, outHand, nil
+}
 
-	// Send handshake
+// Sends our handshake, which signals that we support the extension protocol
+func SendHandshake(conn net.Conn, infoHash []byte, peerId []byte) error {
+	extensions := make([]byte, extensionSize)
+	extensions[extensionByte] |= extensionBit
 	var inHand Handshake = Handshake{
 		byte(19),
 		"BitTorrent protocol",
-		make([]byte, extensionSize),
+		extensions,
 		infoHash,
 		peerId,
 	}
-	var in []byte = inHand.BuildHandshake()
-	_, err = conn.Write(in)
+	_, err := conn.Write(inHand.BuildHandshake())
 	if err != nil {
-		return nil, Handshake{}, &NetworkError{"failed to write to peer"}
+		return &NetworkError{"failed to write to peer"}
 	}
+	return nil
+}
 
-	// Receive handshake
+// Reads the handshake of a peer, which is the first message a peer sends
+func ReadHandshake(conn net.Conn) (Handshake, error) {
 	out, err := ReadFullWithLength(conn, 1, uint32(hashLength+peerIdSize+extensionSize))
 	if err != nil {
-		return nil, Handshake{}, err
+		return Handshake{}, err
 	}
-
-	outHand, err := ParseHandshake(out)
+	h, err := ParseHandshake(out)
 	if err != nil {
-		return nil, Handshake{}, &DecodeError{err.Error()}
+		return Handshake{}, &DecodeError{err.Error()}
 	}
-
-	return conn, outHand, nil
+	return h, nil
 }
 
+// The largest message a peer may send, which is well above a piece message, a metadata message or the
+// bitfield of any torrent we support. Larger lengths are refused before anything is allocated
+const maxMessageSize uint32 = 1 << 20
+
 // A blocking helper function to read data from a TCP connection where the data uses the following schema:
 // A number of bytes n to indicate the size of the message, which is then followed by n bytes of data
 // This function also provides a parameter for extra bytes to support dealing with certain types of messages
@@ -102,6 +136,9 @@ func ReadFullWithLength(conn net.Conn, prefixLength int, extraBytes uint32) ([]b
 	lengthSlice := make([]byte, 4-prefixLength, 4)
 	lengthSlice = append(lengthSlice, bufLength...)
 	var length uint32 = binary.BigEndian.Uint32(lengthSlice)
+	if length > maxMessageSize {
+		return []byte{}, &NetworkError{fmt.Sprintf("peer sent a message of %d bytes, which is too large", length)}
+	}
 
 	// Keep-alive messages are handled by design
 	buf := make([]byte, length+extraBytes)
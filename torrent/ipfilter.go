@@ -0,0 +1,252 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const allowedAccess int = 128 // Entries of an eMule filter with at least this access level are not blocked
+
+// An IP filter which blocks ranges of IPv4 and IPv6 addresses, such as a corporate blocklist. Ranges
+// are kept sorted and merged so that an address is checked with a binary search. It is safe for
+// concurrent use. The following list formats are supported, one range per line:
+// eMule ipfilter.dat:   001.002.003.000 - 001.002.003.255 , 000 , Description
+// PeerGuardian P2P:     Description:1.2.3.0-1.2.3.255
+// CIDR:                 1.2.3.0/24 or 2001:db8::/32
+// Plain ranges and single addresses are also accepted, and lines starting with # are ignored
+type IPFilter struct {
+	mutex     sync.RWMutex
+	ranges    []ipRange
+	rejected  map[string]bool // Every distinct address that was rejected
+	rejection int             // Number of times an address was rejected
+}
+
+// An inclusive range of addresses, where IPv4 addresses are stored as IPv4-mapped IPv6 addresses
+type ipRange struct {
+	start [16]byte
+	end   [16]byte
+}
+
+// Creates an IP filter that does not block anything
+func NewIPFilter() *IPFilter {
+	return &IPFilter{rejected: make(map[string]bool)}
+}
+
+// Loads an IP filter from a list of ranges, see IPFilter for the supported formats
+func LoadIPFilter(path string) (*IPFilter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	f := NewIPFilter()
+	err = f.Load(file)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Adds every range of a list to the filter
+func (f *IPFilter) Load(r io.Reader) error {
+	var ranges []ipRange
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") || strings.HasPrefix(text, "//") {
+			continue
+		}
+		res, blocked, err := parseFilterLine(text)
+		if err != nil {
+			return fmt.Errorf("error parsing ip filter line %d: %w", line, err)
+		}
+		if blocked {
+			ranges = append(ranges, res)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.ranges = mergeRanges(append(f.ranges, ranges...))
+	return nil
+}
+
+// Blocks every address from start to end
+func (f *IPFilter) AddRange(start net.IP, end net.IP) error {
+	res, err := newRange(start, end)
+	if err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.ranges = mergeRanges(append(f.ranges, res))
+	return nil
+}
+
+// Checks whether an address is blocked without counting it as rejected
+func (f *IPFilter) Blocked(ip net.IP) bool {
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return false
+	}
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	// Find the first range that ends at or after the address
+	i := sort.Search(len(f.ranges), func(i int) bool {
+		return bytes.Compare(f.ranges[i].end[:], ip16) >= 0
+	})
+	return i < len(f.ranges) && bytes.Compare(f.ranges[i].start[:], ip16) <= 0
+}
+
+// Checks whether an address may be connected to, blocked addresses are counted as rejected
+func (f *IPFilter) Allow(ip net.IP) bool {
+	if !f.Blocked(ip) {
+		return true
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.rejected[ip.String()] = true
+	f.rejection++
+	return false
+}
+
+// Gets the number of distinct addresses that were rejected and the number of rejections
+func (f *IPFilter) Rejected() (int, int) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return len(f.rejected), f.rejection
+}
+
+// Gets the number of ranges in the filter once overlapping ranges are merged
+func (f *IPFilter) Len() int {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return len(f.ranges)
+}
+
+// Helper function to parse a single line of a filter list, returns false if the line does not block anything
+func parseFilterLine(line string) (ipRange, bool, error) {
+	// eMule, where entries with a high access level are allowed
+	if fields := strings.Split(line, ","); len(fields) >= 2 {
+		access, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		res, rangeErr := parseRange(fields[0])
+		if err == nil && rangeErr == nil {
+			return res, access < allowedAccess, nil
+		}
+	}
+
+	// PeerGuardian, where the description ends at the last colon before a range and may contain anything
+	if i := strings.LastIndex(line, ":"); i >= 0 && strings.Contains(line[i+1:], "-") {
+		if res, err := parseRange(line[i+1:]); err == nil {
+			return res, true, nil
+		}
+	}
+
+	// CIDR, which is only a bare address and prefix
+	if strings.Contains(line, "/") {
+		_, network, err := net.ParseCIDR(line)
+		if err != nil {
+			return ipRange{}, false, err
+		}
+		end := make(net.IP, len(network.IP))
+		for i := range network.IP {
+			end[i] = network.IP[i] | ^network.Mask[i]
+		}
+		res, err := newRange(network.IP, end)
+		return res, true, err
+	}
+
+	res, err := parseRange(line)
+	return res, true, err
+}
+
+// Helper function to parse a range of the form start-end, or a single address
+func parseRange(text string) (ipRange, error) {
+	start, end, found := strings.Cut(text, "-")
+	if !found {
+		end = start
+	}
+	return newRange(parseAddress(start), parseAddress(end))
+}
+
+// Helper function to parse an address, where IPv4 addresses may be padded with zeros as in eMule lists
+func parseAddress(text string) net.IP {
+	text = strings.TrimSpace(text)
+	if strings.Contains(text, ":") {
+		return net.ParseIP(text)
+	}
+	octets := strings.Split(text, ".")
+	if len(octets) != 4 {
+		return nil
+	}
+	ip := make(net.IP, 4)
+	for i := range octets {
+		octet, err := strconv.Atoi(octets[i])
+		if err != nil || octet < 0 || octet > 255 {
+			return nil
+		}
+		ip[i] = byte(octet)
+	}
+	return ip
+}
+
+// Helper function to create a range, where both addresses must be of the same family
+func newRange(start net.IP, end net.IP) (ipRange, error) {
+	if start == nil || end == nil || (start.To4() == nil) != (end.To4() == nil) {
+		return ipRange{}, fmt.Errorf("invalid address range")
+	}
+	var res ipRange
+	copy(res.start[:], start.To16())
+	copy(res.end[:], end.To16())
+	if bytes.Compare(res.start[:], res.end[:]) > 0 {
+		return ipRange{}, fmt.Errorf("range starts after it ends")
+	}
+	return res, nil
+}
+
+// Helper function to sort ranges and merge those that overlap or touch
+func mergeRanges(ranges []ipRange) []ipRange {
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].start[:], ranges[j].start[:]) < 0
+	})
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if len(merged) > 0 {
+			last := &merged[len(merged)-1]
+			next, overflow := nextAddress(last.end)
+			if overflow || bytes.Compare(r.start[:], next[:]) <= 0 {
+				if bytes.Compare(r.end[:], last.end[:]) > 0 {
+					last.end = r.end
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// Helper function to get the address after an address, returns true if there is no such address
+func nextAddress(ip [16]byte) ([16]byte, bool) {
+	for i := len(ip) - 1; i >= 0; i-- {
+		ip[i]++
+		if ip[i] != 0 {
+			return ip, false
+		}
+	}
+	return ip, true
+}
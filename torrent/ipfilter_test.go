@@ -0,0 +1,62 @@
+package torrent
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestIPFilter(t *testing.T) {
+	list := strings.Join([]string{
+		"# A comment",
+		"001.002.003.000 - 001.002.003.255 , 000 , eMule entry",
+		"010.000.000.000 - 010.255.255.255 , 200 , Allowed eMule entry",
+		"Some Org, Inc:5.6.7.8-5.6.7.20",
+		"AT&T Labs/Research:7.7.7.0-7.7.7.255",
+		"192.168.0.0/16",
+		"192.169.0.0/16", // Touches the previous range
+		"2001:db8::/32",
+		"9.9.9.9",
+	}, "\n")
+	filter := NewIPFilter()
+	if err := filter.Load(strings.NewReader(list)); err != nil {
+		t.Fatal(err)
+	}
+	if filter.Len() != 6 {
+		t.Errorf("expected: %d ranges -> got: %d", 6, filter.Len())
+	}
+
+	tests := map[string]bool{
+		"1.2.3.0":       true,
+		"1.2.3.255":     true,
+		"1.2.4.0":       false,
+		"10.1.1.1":      false,
+		"5.6.7.10":      true,
+		"5.6.7.21":      false,
+		"7.7.7.7":       true,
+		"192.169.255.1": true,
+		"9.9.9.9":       true,
+		"2001:db8::1":   true,
+		"2001:db9::1":   false,
+	}
+	for ip, blocked := range tests {
+		if got := filter.Blocked(net.ParseIP(ip)); got != blocked {
+			t.Errorf("%s: expected: %t -> got: %t", ip, blocked, got)
+		}
+	}
+
+	// Rejections are counted per attempt and per address
+	filter.Allow(net.ParseIP("9.9.9.9"))
+	filter.Allow(net.ParseIP("9.9.9.9"))
+	filter.Allow(net.ParseIP("1.2.4.0"))
+	if addresses, attempts := filter.Rejected(); addresses != 1 || attempts != 2 {
+		t.Errorf("expected: 1 address and 2 attempts -> got: %d and %d", addresses, attempts)
+	}
+
+	for _, line := range []string{"not an address", "1.2.3.0/33", "Description:1.2.3.0-1.2.3.999"} {
+		err := filter.Load(strings.NewReader(line))
+		if _, ok := err.(*DecodeError); err == nil || ok {
+			t.Errorf("%s: expected: an ip filter error -> got: %v", line, err)
+		}
+	}
+}
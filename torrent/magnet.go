@@ -0,0 +1,96 @@
+package torrent
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// The parts of a magnet link that are needed to download its torrent, whose info dictionary is fetched
+// from peers before the download can start
+type Magnet struct {
+	InfoHash   []byte // The v1 info hash, which is nil for v2 only links
+	InfoHashV2 []byte // The full v2 info hash, which is nil unless the link has one
+	Name       string
+	Trackers   []string
+	Peers      []Peer // Peers that the link names directly
+}
+
+// Builds a magnet link of a torrent with its info hashes, name, size and tracker. Hybrid torrents get
+// both hashes, where the v2 hash is a multihash of SHA-256
+// The format of a magnet link can be found here: https://www.bittorrent.org/beps/bep_0009.html
+func (torrent *Torrent) Magnet() string {
+	var parts []string
+	if !torrent.V2Only() {
+		parts = append(parts, "xt=urn:btih:"+hex.EncodeToString(torrent.InfoHash))
+	}
+	if torrent.InfoHashV2 != nil {
+		parts = append(parts, "xt=urn:btmh:1220"+hex.EncodeToString(torrent.InfoHashV2))
+	}
+	parts = append(parts, "dn="+url.QueryEscape(torrent.Name), fmt.Sprintf("xl=%d", torrent.Length))
+	if torrent.Announce != "" {
+		parts = append(parts, "tr="+url.QueryEscape(torrent.Announce))
+	}
+	return "magnet:?" + strings.Join(parts, "&")
+}
+
+// Parses a magnet link, which must have a v1 info hash in hex or base32, a v2 info hash as a SHA-256
+// multihash, or both. Peers given with x.pe that are not an IP address and port are ignored
+func ParseMagnet(link string) (Magnet, error) {
+	u, err := url.Parse(link)
+	if err != nil || u.Scheme != "magnet" {
+		return Magnet{}, &TorrentError{"not a magnet link"}
+	}
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return Magnet{}, &TorrentError{"invalid magnet link: " + err.Error()}
+	}
+
+	var m Magnet
+	for _, xt := range query["xt"] {
+		if hash, ok := strings.CutPrefix(xt, "urn:btih:"); ok {
+			switch len(hash) {
+			case 2 * hashLength:
+				m.InfoHash, err = hex.DecodeString(hash)
+			case 32:
+				m.InfoHash, err = base32.StdEncoding.DecodeString(strings.ToUpper(hash))
+			default:
+				err = fmt.Errorf("wrong length")
+			}
+			if err != nil {
+				return Magnet{}, &TorrentError{"invalid info hash: " + hash}
+			}
+		} else if hash, ok := strings.CutPrefix(xt, "urn:btmh:1220"); ok {
+			m.InfoHashV2, err = hex.DecodeString(hash)
+			if err != nil || len(m.InfoHashV2) != merkleHashLength {
+				return Magnet{}, &TorrentError{"invalid v2 info hash: " + hash}
+			}
+		}
+	}
+	if m.InfoHash == nil && m.InfoHashV2 == nil {
+		return Magnet{}, &TorrentError{"magnet link has no info hash"}
+	}
+	m.Name = query.Get("dn")
+	m.Trackers = query["tr"]
+	for _, address := range query["x.pe"] {
+		host, port, err := net.SplitHostPort(address)
+		ip := net.ParseIP(host)
+		number, err2 := strconv.ParseUint(port, 10, 16)
+		if err == nil && err2 == nil && ip != nil {
+			m.Peers = append(m.Peers, Peer{ip, uint16(number)})
+		}
+	}
+	return m, nil
+}
+
+// Gets the info hash that is sent in handshakes and to trackers, which is truncated for v2 only links
+func (m *Magnet) HandshakeHash() []byte {
+	if m.InfoHash != nil {
+		return m.InfoHash
+	}
+	return m.InfoHashV2[:hashLength]
+}
@@ -0,0 +1,35 @@
+package torrent
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestParseMagnet(t *testing.T) {
+	torr := Torrent{Announce: "http://example.com/announce", InfoHash: bytes.Repeat([]byte{0xab}, hashLength), Name: "a b", Length: 10}
+
+	// A link that we build parses back to the same torrent
+	m, err := ParseMagnet(torr.Magnet())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(m.InfoHash, torr.InfoHash) || m.Name != torr.Name || len(m.Trackers) != 1 || m.Trackers[0] != torr.Announce {
+		t.Errorf("unexpected magnet: %+v", m)
+	}
+
+	// Info hashes may be in base32 and peers may be given directly, where invalid peers are ignored
+	m, err = ParseMagnet("magnet:?xt=urn:btih:VOV2XK5LVOV2XK5LVOV2XK5LVOV2XK5L&x.pe=1.2.3.4:5&x.pe=example.com:6&x.pe=bad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(m.InfoHash, torr.InfoHash) || len(m.Peers) != 1 || !m.Peers[0].IP.Equal(net.IPv4(1, 2, 3, 4)) || m.Peers[0].Port != 5 {
+		t.Errorf("unexpected magnet: %+v", m)
+	}
+
+	for _, link := range []string{"http://example.com", "magnet:?dn=name", "magnet:?xt=urn:btih:abc", "magnet:?xt=urn:btmh:1220abcd"} {
+		if _, err := ParseMagnet(link); err == nil {
+			t.Errorf("expected error for %s", link)
+		}
+	}
+}
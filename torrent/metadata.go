@@ -0,0 +1,261 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const utMetadata byte = 1                // Our extended message id of ut_metadata
+const metadataPieceSize int = 16384      // The info dictionary is sent in pieces of 16 KiB
+const maxMetadataSize int = 16 << 20     // Largest info dictionary that is accepted from a peer
+const metadataPeers int = 5              // Number of peers that are asked for the metadata at once
+const metadataTimeout = 30 * time.Second // Max time for a peer to send the whole info dictionary
+const metadataLeft uint32 = 1            // Sent to trackers as left since the size is not known yet
+
+// Types of ut_metadata messages
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+// Options of fetching the metadata of a magnet link, where every field may be left empty
+type MetadataOptions struct {
+	Port             uint16               // The port that we accept connections on, which is told to trackers
+	Allow            func(ip net.IP) bool // Peers that this returns false for are never connected to
+	HandshakeTimeout time.Duration        // Max time to connect to a peer, which defaults to DefaultHandshakeTimeout
+	Output           io.Writer            // Where errors of trackers and peers are printed
+}
+
+// Fetches the info dictionary of a magnet link from peers, which are found through the trackers of the
+// link and the peers it names, and builds the torrent from it. The exchange can be found here:
+// https://www.bittorrent.org/beps/bep_0009.html
+func (m *Magnet) FetchMetadata(ctx context.Context, peerId []byte, opts MetadataOptions) (Torrent, error) {
+	if opts.HandshakeTimeout == 0 {
+		opts.HandshakeTimeout = DefaultHandshakeTimeout
+	}
+	if opts.Output == nil {
+		opts.Output = io.Discard
+	}
+	if len(m.Trackers) == 0 {
+		return Torrent{}, &TorrentError{"magnet link has no trackers, which are needed to find peers"}
+	}
+	peers := append([]Peer{}, m.Peers...)
+	var trackerErr error // The last error of a tracker, which explains why no peers were found
+	for _, tracker := range m.Trackers {
+		torr := Torrent{Announce: tracker, InfoHash: m.HandshakeHash()}
+		found, err := torr.GetPeers(ctx, peerId, opts.Port, 0, metadataLeft)
+		if err != nil {
+			fmt.Fprintln(opts.Output, err)
+			trackerErr = err
+			continue
+		}
+		peers = append(peers, found...)
+	}
+	if len(peers) == 0 && trackerErr != nil {
+		return Torrent{}, trackerErr
+	}
+	if len(peers) == 0 {
+		return Torrent{}, &NetworkError{"no peers found for magnet link"}
+	}
+
+	// The first peer that sends a valid info dictionary wins and the others are abandoned
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan []byte)
+	go func() {
+		var wg sync.WaitGroup
+		slots := make(chan struct{}, metadataPeers)
+		for _, peer := range peers {
+			if opts.Allow != nil && !opts.Allow(peer.IP) {
+				continue
+			}
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+			}
+			if ctx.Err() != nil {
+				break
+			}
+			wg.Add(1)
+			go func(peer Peer) {
+				defer wg.Done()
+				defer func() { <-slots }()
+				info, err := m.fetchInfo(ctx, peer, peerId, opts.HandshakeTimeout)
+				if err != nil {
+					fmt.Fprintln(opts.Output, err)
+					return
+				}
+				select {
+				case results <- info:
+				case <-ctx.Done():
+				}
+			}(peer)
+		}
+		wg.Wait()
+		close(results)
+	}()
+
+	info, ok := <-results
+	if !ok {
+		if ctx.Err() != nil {
+			return Torrent{}, ctx.Err()
+		}
+		return Torrent{}, &NetworkError{"no peer sent the metadata of the magnet link"}
+	}
+	return ParseMetainfo(m.metainfo(info))
+}
+
+// Helper function to get the info dictionary from a single peer, which is checked against the info hashes
+func (m *Magnet) fetchInfo(ctx context.Context, peer Peer, peerId []byte, timeout time.Duration) ([]byte, error) {
+	conn, handshake, err := peer.PeerHandshake(ctx, m.HandshakeHash(), peerId, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	if !SupportsExtensions(handshake.Extensions) {
+		return nil, &NetworkError{"peer does not support extensions: " + peer.String()}
+	}
+	conn.SetDeadline(time.Now().Add(metadataTimeout))
+	extended := buildMetadataHandshake()
+	_, err = conn.Write(extended.BuildMessage())
+	if err != nil {
+		return nil, &NetworkError{"failed to write to peer"}
+	}
+
+	var info []byte
+	var received []bool
+	left := 0
+	for {
+		buf, err := ReadFullWithLength(conn, 4, 0)
+		if err != nil {
+			return nil, err
+		}
+		msg, err := ParseMessage(buf)
+		if err != nil {
+			return nil, err
+		}
+		if msg.Type != Extended || len(msg.Payload) < 2 {
+			continue // Such as the bitfield of the peer
+		}
+
+		switch msg.Payload[0] {
+		case extendedHandshake:
+			if info != nil {
+				continue
+			}
+			h, err := ParseExtendedHandshake(msg.Payload)
+			if err != nil {
+				return nil, err
+			}
+			id, ok := h.Messages["ut_metadata"]
+			if !ok || h.MetadataSize <= 0 || h.MetadataSize > maxMetadataSize {
+				return nil, &NetworkError{"peer can't send the metadata: " + peer.String()}
+			}
+			info = make([]byte, h.MetadataSize)
+			left = (h.MetadataSize + metadataPieceSize - 1) / metadataPieceSize
+			received = make([]bool, left)
+			for i := range left {
+				request := buildMetadataMessage(byte(id), map[string]interface{}{"msg_type": metadataRequest, "piece": i})
+				_, err = conn.Write(request.BuildMessage())
+				if err != nil {
+					return nil, &NetworkError{"failed to write to peer"}
+				}
+			}
+		case utMetadata:
+			if info == nil {
+				continue
+			}
+			piece, data, err := parseMetadataMessage(msg.Payload[1:], received)
+			if err != nil {
+				return nil, err
+			}
+			if piece < 0 {
+				continue
+			}
+			start := piece * metadataPieceSize
+			if len(data) != min(metadataPieceSize, len(info)-start) {
+				return nil, &DecodeError{"metadata piece has the wrong length"}
+			}
+			copy(info[start:], data)
+			received[piece] = true
+			left--
+			if left == 0 {
+				if !m.validInfo(info) {
+					return nil, &NetworkError{"peer sent metadata that does not match the info hash: " + peer.String()}
+				}
+				return info, nil
+			}
+		}
+	}
+}
+
+// Helper function to parse a ut_metadata message, returns the index and data of a new piece or -1 for
+// messages that are ignored, such as pieces that were already received
+func parseMetadataMessage(payload []byte, received []bool) (int, []byte, error) {
+	res, length, err := DecodeBencode(string(payload))
+	if err != nil {
+		return 0, nil, err
+	}
+	dict, ok := res.(map[string]interface{})
+	if !ok {
+		return 0, nil, &DecodeError{"metadata message not dictionary"}
+	}
+	msgType, _ := dict["msg_type"].(int)
+	piece, ok := dict["piece"].(int)
+	switch {
+	case msgType == metadataReject:
+		return 0, nil, &NetworkError{"peer rejected a metadata request"}
+	case msgType != metadataData:
+		return -1, nil, nil // Requests of our own metadata, which we do not have
+	case !ok || piece < 0 || piece >= len(received):
+		return 0, nil, &DecodeError{"metadata piece out of range"}
+	case received[piece]:
+		return -1, nil, nil
+	}
+	return piece, payload[length:], nil
+}
+
+// Helper function to check the info dictionary against every info hash of the link
+func (m *Magnet) validInfo(info []byte) bool {
+	if m.InfoHash != nil && !bytes.Equal(GetHash(info), m.InfoHash) {
+		return false
+	}
+	return m.InfoHashV2 == nil || bytes.Equal(GetHashV2(info), m.InfoHashV2)
+}
+
+// Helper function to build the contents of a torrent file from an info dictionary and the trackers of
+// the link, where each tracker is its own tier. The info dictionary is kept as is so its hash is unchanged
+func (m *Magnet) metainfo(info []byte) []byte {
+	announce, _ := EncodeBencode(m.Trackers[0])
+	tiers := make([]interface{}, len(m.Trackers))
+	for i, tracker := range m.Trackers {
+		tiers[i] = []interface{}{tracker}
+	}
+	announceList, _ := EncodeBencode(tiers)
+	return []byte("d8:announce" + announce + "13:announce-list" + announceList + "4:info" + string(info) + "e")
+}
+
+// Helper function to build our extended handshake for fetching metadata, which adds ut_metadata
+func buildMetadataHandshake() Message {
+	bencode, _ := EncodeBencode(map[string]interface{}{
+		"m": map[string]interface{}{"ut_metadata": int(utMetadata)},
+		"v": clientName,
+	})
+	payload := append([]byte{extendedHandshake}, bencode...)
+	return Message{uint32(len(payload) + 1), Extended, payload}
+}
+
+// Helper function to build a ut_metadata message for the extended message id of a peer
+func buildMetadataMessage(id byte, dict map[string]interface{}) Message {
+	bencode, _ := EncodeBencode(dict)
+	payload := append([]byte{id}, bencode...)
+	return Message{uint32(len(payload) + 1), Extended, payload}
+}
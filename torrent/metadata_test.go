@@ -0,0 +1,112 @@
+package torrent
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Helper function to act as a peer that sends an info dictionary in response to ut_metadata requests,
+// whichever info hash it is asked for
+func fakeMetadataPeer(listener net.Listener, info []byte) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			theirs, err := ReadHandshake(conn)
+			if err != nil {
+				return
+			}
+			SendHandshake(conn, theirs.InfoHash, []byte(strings.Repeat("p", peerIdSize)))
+			bencode, _ := EncodeBencode(map[string]interface{}{"m": map[string]interface{}{"ut_metadata": 3}, "metadata_size": len(info)})
+			payload := append([]byte{extendedHandshake}, bencode...)
+			handshake := Message{uint32(len(payload) + 1), Extended, payload}
+			conn.Write(handshake.BuildMessage())
+
+			id := 0
+			for {
+				buf, err := ReadFullWithLength(conn, 4, 0)
+				if err != nil {
+					return
+				}
+				msg, err := ParseMessage(buf)
+				if err != nil || msg.Type != Extended || len(msg.Payload) < 2 {
+					continue
+				}
+				if msg.Payload[0] == extendedHandshake {
+					h, _ := ParseExtendedHandshake(msg.Payload)
+					id = h.Messages["ut_metadata"]
+					continue
+				}
+				res, _, _ := DecodeBencode(string(msg.Payload[1:]))
+				piece := res.(map[string]interface{})["piece"].(int)
+				data := info[piece*metadataPieceSize : min((piece+1)*metadataPieceSize, len(info))]
+				reply := buildMetadataMessage(byte(id), map[string]interface{}{"msg_type": metadataData, "piece": piece, "total_size": len(info)})
+				reply.Payload = append(reply.Payload, data...)
+				reply.Length += uint32(len(data))
+				conn.Write(reply.BuildMessage())
+			}
+		}()
+	}
+}
+
+func TestFetchMetadata(t *testing.T) {
+	// The info dictionary is larger than a single metadata piece
+	const pieces = 1000
+	bencode, _ := EncodeBencode(map[string]interface{}{
+		"name":         "data",
+		"piece length": 16384,
+		"length":       pieces * 16384,
+		"pieces":       strings.Repeat(string(GetHash(make([]byte, 16384))), pieces),
+	})
+	info := []byte(bencode)
+	if len(info) <= metadataPieceSize {
+		t.Fatalf("expected more than one metadata piece")
+	}
+	infoHash := GetHash(info)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go fakeMetadataPeer(listener, info)
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali60e5:peers0:e"))
+	}))
+	defer tracker.Close()
+	refusing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d14:failure reason4:oopse"))
+	}))
+	defer refusing.Close()
+
+	// A tracker that refuses the announce is skipped as long as peers are found elsewhere
+	address := listener.Addr().(*net.TCPAddr)
+	m := Magnet{InfoHash: infoHash, Trackers: []string{tracker.URL, refusing.URL}, Peers: []Peer{{address.IP, uint16(address.Port)}}}
+	peerId := []byte(strings.Repeat("o", peerIdSize))
+	torr, err := m.FetchMetadata(context.Background(), peerId, MetadataOptions{Port: 6881})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if torr.Name != "data" || len(torr.PieceHashes) != pieces || torr.Announce != tracker.URL || string(torr.InfoHash) != string(infoHash) {
+		t.Errorf("unexpected torrent: %s %d %s", torr.Name, len(torr.PieceHashes), torr.Announce)
+	}
+
+	// Metadata that does not match the info hash is refused
+	m.InfoHash = GetHash([]byte("other"))
+	if _, err := m.FetchMetadata(context.Background(), peerId, MetadataOptions{Port: 6881}); err == nil {
+		t.Errorf("expected error for metadata of another torrent")
+	}
+
+	// Without any peers, the reason the tracker refused is returned
+	m = Magnet{InfoHash: infoHash, Trackers: []string{refusing.URL}}
+	if _, err := m.FetchMetadata(context.Background(), peerId, MetadataOptions{Port: 6881}); err == nil || !strings.Contains(err.Error(), "oops") {
+		t.Errorf("expected: error with the failure reason -> got: %v", err)
+	}
+}
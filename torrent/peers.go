@@ -1,6 +1,7 @@
 package torrent
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -31,8 +32,10 @@ func (n *NetworkError) Error() string {
 	return n.err
 }
 
-// Gets the peers of a torrent by sending a GET request to the torrent tracker
-func (torrent *Torrent) GetPeers(peerId []byte) ([]Peer, error) {
+// Gets the peers of a torrent by sending a GET request to the torrent tracker, where port is the port
+// we accept connections on, downloaded is the number of bytes downloaded so far and left is the number
+// of bytes still needed. The request is abandoned once ctx is cancelled
+func (torrent *Torrent) GetPeers(ctx context.Context, peerId []byte, port uint16, downloaded uint32, left uint32) ([]Peer, error) {
 	// Build the url
 	base, err := url.Parse(torrent.Announce)
 	if err != nil {
@@ -40,17 +43,21 @@ func (torrent *Torrent) GetPeers(peerId []byte) ([]Peer, error) {
 	}
 	query := url.Values{
 		"info_hash":  []string{string(torrent.InfoHash)},
-		"peer_id":    []string{string(peerId)},             // A randomly generated peer ID
-		"port":       []string{"6881"},                     // The default port as per the specification
-		"uploaded":   []string{"0"},                        // We do not support seeding
-		"downloaded": []string{"0"},                        // Start at zero
-		"left":       []string{fmt.Sprint(torrent.Length)}, // We do not support resuming
+		"peer_id":    []string{string(peerId)}, // A randomly generated peer ID
+		"port":       []string{fmt.Sprint(port)},
+		"uploaded":   []string{"0"},                    // We do not support seeding
+		"downloaded": []string{fmt.Sprint(downloaded)}, // Includes pieces resumed from disk
+		"left":       []string{fmt.Sprint(left)},
 		"compact":    []string{"1"},
 	}
 	base.RawQuery = query.Encode()
 
 	// Send GET request
-	res, err := http.Get(base.String())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base.String(), nil)
+	if err != nil {
+		return []Peer{}, &DecodeError{"unable to parse tracker URL"}
+	}
+	res, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return []Peer{}, &NetworkError{"failed to get peers"}
 	}
@@ -63,31 +70,32 @@ func (torrent *Torrent) GetPeers(peerId []byte) ([]Peer, error) {
 		return []Peer{}, &NetworkError{fmt.Sprintf("failed to get peers with status: %s \n"+"and body: %s", res.Status, body)}
 	}
 
-	peers, err := ParsePeers(string(body))
-	if err != nil {
-		return []Peer{}, &DecodeError{err.Error()}
-	}
-
-	return peers, nil
+	return ParsePeers(string(body))
 }
 
-// Helper function that parses peers into a structure
+// Helper function that parses peers into a structure, a tracker that refuses the announce gives its reason
 func ParsePeers(bencode string) ([]Peer, error) {
 	res, _, err := DecodeBencode(bencode)
 	if err != nil {
-		return []Peer{}, err
+		return []Peer{}, &DecodeError{err.Error()}
 	}
 
 	// TODO: implement usage of the interval key
-	info := res.(map[string]interface{})
-	strPeers := info["peers"].(string)
+	info, _ := res.(map[string]interface{})
+	if reason, ok := info["failure reason"].(string); ok {
+		return []Peer{}, &NetworkError{"tracker refused the announce: " + reason}
+	}
+	strPeers, ok := info["peers"].(string)
+	if !ok {
+		return []Peer{}, &DecodeError{"bencode missing peers"}
+	}
 
 	// Populate torrent structure array
 	peers := make([]Peer, 0, len(strPeers)/peerSize)
 	var bytePeers [][]byte
 	bytePeers, err = SplitPieces(strPeers, peerSize) // Defined in torrent.go
 	if err != nil {
-		return []Peer{}, err
+		return []Peer{}, &DecodeError{"invalid peers"}
 	}
 
 	// Build array of peers
@@ -0,0 +1,43 @@
+package torrent
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParsePeers(t *testing.T) {
+	tests := []struct {
+		bencode string
+		want    []Peer
+		err     error // The type of the error, if any
+	}{
+		{"d5:peers6:\x7f\x00\x00\x01\x1a\xe1e", []Peer{{[]byte{127, 0, 0, 1}, 6881}}, nil},
+		{"d14:failure reason4:oopse", nil, &NetworkError{}},
+		{"d8:intervali900ee", nil, &DecodeError{}},
+		{"d5:peers5:abcdee", nil, &DecodeError{}},
+		{"le", nil, &DecodeError{}},
+		{"d5:peers", nil, &DecodeError{}},
+	}
+	for _, test := range tests {
+		got, err := ParsePeers(test.bencode)
+		var networkError *NetworkError
+		var decodeError *DecodeError
+		switch test.err.(type) {
+		case nil:
+			if err != nil || len(got) != len(test.want) || got[0].String() != test.want[0].String() {
+				t.Errorf("ParsePeers(%q) = %v, %v, want %v", test.bencode, got, err, test.want)
+			}
+		case *NetworkError:
+			if !errors.As(err, &networkError) {
+				t.Errorf("ParsePeers(%q) = %v, %v, want a network error", test.bencode, got, err)
+			}
+		case *DecodeError:
+			if !errors.As(err, &decodeError) {
+				t.Errorf("ParsePeers(%q) = %v, %v, want a decode error", test.bencode, got, err)
+			}
+		}
+	}
+	if _, err := ParsePeers("d14:failure reason4:oopse"); err == nil || err.Error() != "tracker refused the announce: oops" {
+		t.Errorf("expected: the failure reason -> got: %v", err)
+	}
+}
@@ -0,0 +1,535 @@
+package torrent
+
+import (
+	"bytes"
+	"math/rand"
+	"sync"
+)
+
+const randomFirst int = 4             // Number of pieces picked at random so that we have something to share quickly
+const streamingWindow int64 = 8 << 20 // Bytes after the playhead that are picked in order by the streaming strategy
+
+// A request for a block of a piece, which is 16 KiB apart from the last block of a piece
+type Block struct {
+	Index  int
+	Begin  int
+	Length int
+}
+
+// A piece picker which tracks how many peers have each piece and hands out blocks of the piece with the
+// highest priority that a peer has. Among pieces of the same priority the strategy decides, where the
+// default of picking the rarest piece spreads pieces evenly across the swarm. Blocks of a piece can come
+// from several peers and survive a peer disconnecting. It is safe for concurrent use
+type Picker struct {
+	mutex        sync.Mutex
+	torrent      *Torrent
+	availability []int  // Number of connected peers that have each piece
+	state        []byte // The state of each piece, see below
+	partial      map[int]*partialPiece
+	picked       int
+	needed       int        // Number of blocks of wanted pieces that are not requested, endgame waits until none are left
+	wasted       int64      // Number of bytes received for blocks that another peer delivered first
+	priority     []Priority // The priority of each piece
+	strategy     Strategy
+	playhead     int // The piece that the streaming strategy picks in order from
+}
+
+const (
+	pieceNeeded     byte = 0
+	pieceInProgress byte = 1
+	pieceDone       byte = 2
+)
+
+// A piece that is in progress, which holds every block received so far
+type partialPiece struct {
+	data     []byte
+	blocks   []byte   // The state of each block, see below
+	requests []int    // Number of peers that requested each block, only above one during endgame
+	sources  []string // The peer that delivered each block
+	received int
+
+	// Once a piece fails its hash check it is downloaded again from a single peer, and the hashes of the
+	// blocks that failed are kept so that the peers that sent bad blocks are found once the piece is valid
+	exclusive      bool
+	owner          string
+	suspect        [][]byte
+	suspectSources []string
+}
+
+const (
+	blockNeeded    byte = 0
+	blockRequested byte = 1
+	blockReceived  byte = 2
+)
+
+// Creates a picker for a torrent, where pieces that are already complete are never picked
+func NewPicker(t *Torrent, complete []bool) *Picker {
+	pieces := len(t.PieceHashes)
+	p := Picker{
+		torrent:      t,
+		availability: make([]int, pieces),
+		state:        make([]byte, pieces),
+		partial:      make(map[int]*partialPiece),
+		strategy:     StrategyRarest,
+	}
+	for i := range complete {
+		if complete[i] {
+			p.state[i] = pieceDone
+		}
+	}
+	p.SetPriorities(nil)
+	return &p
+}
+
+// Adds the pieces of a peer, which should be called once a bitfield is received
+func (p *Picker) AddBitfield(bitfield []byte) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for i := range p.availability {
+		if HavePiece(bitfield, i) {
+			p.availability[i]++
+		}
+	}
+}
+
+// Removes the pieces of a peer, which should be called once a peer disconnects
+func (p *Picker) RemoveBitfield(bitfield []byte) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for i := range p.availability {
+		if HavePiece(bitfield, i) {
+			p.availability[i]--
+		}
+	}
+}
+
+// Adds a single piece of a peer, which should be called once a have message is received
+func (p *Picker) AddHave(index int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if index >= 0 && index < len(p.availability) {
+		p.availability[index]++
+	}
+}
+
+// Picks a block for a peer to request, preferring pieces of priority now and then pieces that are already
+// in progress, unless the peer has a needed piece of a higher priority, in which case the next piece is
+// started as decided by priority and strategy. Once every remaining block is requested, endgame begins and
+// blocks are requested from several peers, again preferring pieces of a higher priority.
+// Blocks the peer has already requested are never picked, nor are blocks of skipped pieces or of a piece
+// that another peer is downloading alone after a failed hash check
+// Returns false if the peer has no block that we need
+func (p *Picker) PickBlock(bitfield []byte, requested []Block, peer string) (Block, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if block, ok := p.pickNow(bitfield, peer); ok {
+		return block, true
+	}
+
+	// Finish pieces that are in progress first so that they can be shared sooner, starting with the piece
+	// of the highest priority
+	partialIndex, partialBlock, partialPriority := 0, 0, PrioritySkip
+	for index, partial := range p.partial {
+		if !HavePiece(bitfield, index) || !partial.allows(peer) || p.priority[index] <= partialPriority {
+			continue
+		}
+		for i := range partial.blocks {
+			if partial.blocks[i] == blockNeeded {
+				partialIndex, partialBlock, partialPriority = index, i, p.priority[index]
+				break
+			}
+		}
+	}
+
+	if index, ok := p.pickPiece(bitfield, partialPriority); ok {
+		p.start(index)
+		return p.request(index, 0, peer), true
+	}
+	if partialPriority != PrioritySkip {
+		return p.request(partialIndex, partialBlock, peer), true
+	}
+
+	// Endgame, where the block of the highest priority with the fewest requests is requested again. It only
+	// begins once no peer has anything left to request, not just this peer
+	if p.needed > 0 {
+		return Block{}, false
+	}
+	best, bestRequests, bestPriority := Block{}, -1, PrioritySkip
+	for index, partial := range p.partial {
+		if !HavePiece(bitfield, index) || !partial.allows(peer) || p.priority[index] < bestPriority || p.priority[index] == PrioritySkip {
+			continue
+		}
+		for i := range partial.blocks {
+			block := p.block(index, i)
+			if partial.blocks[i] != blockRequested || containsBlock(requested, block) {
+				continue
+			}
+			if bestRequests < 0 || p.priority[index] > bestPriority || partial.requests[i] < bestRequests {
+				best, bestRequests, bestPriority = block, partial.requests[i], p.priority[index]
+			}
+		}
+	}
+	if bestRequests < 0 {
+		return Block{}, false
+	}
+	return p.request(best.Index, best.Begin/int(blockSize), peer), true
+}
+
+// Helper function to pick a block of the first piece of priority now that a peer has, whether it is in
+// progress or not. Returns false if the peer has no such piece that we need
+func (p *Picker) pickNow(bitfield []byte, peer string) (Block, bool) {
+	for index := range p.priority {
+		if p.priority[index] != PriorityNow || !HavePiece(bitfield, index) {
+			continue
+		}
+		switch p.state[index] {
+		case pieceNeeded:
+			p.state[index] = pieceInProgress
+			p.picked++
+			p.start(index)
+			return p.request(index, 0, peer), true
+		case pieceInProgress:
+			partial := p.partial[index]
+			if !partial.allows(peer) {
+				continue
+			}
+			for i := range partial.blocks {
+				if partial.blocks[i] == blockNeeded {
+					return p.request(index, i, peer), true
+				}
+			}
+		}
+	}
+	return Block{}, false
+}
+
+// Helper function to start downloading a piece that was picked
+func (p *Picker) start(index int) {
+	blocks := p.blockCount(index)
+	p.partial[index] = &partialPiece{
+		data:     make([]byte, p.torrent.PieceSize(index)),
+		blocks:   make([]byte, blocks),
+		requests: make([]int, blocks),
+		sources:  make([]string, blocks),
+	}
+}
+
+// Helper function to get the number of blocks of a piece
+func (p *Picker) blockCount(index int) int {
+	return (p.torrent.PieceSize(index) + int(blockSize) - 1) / int(blockSize)
+}
+
+// Helper function to count the blocks of wanted pieces that are not requested, which is needed whenever
+// pieces become wanted or skipped
+func (p *Picker) countNeeded() {
+	p.needed = 0
+	for i := range p.state {
+		if p.priority[i] == PrioritySkip {
+			continue
+		}
+		switch p.state[i] {
+		case pieceNeeded:
+			p.needed += p.blockCount(i)
+		case pieceInProgress:
+			for _, state := range p.partial[i].blocks {
+				if state == blockNeeded {
+					p.needed++
+				}
+			}
+		}
+	}
+}
+
+// Sets the priority of every piece, where pieces beyond the end of priorities are of normal priority
+func (p *Picker) SetPriorities(priorities []Priority) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.priority = make([]Priority, len(p.state))
+	for i := range p.priority {
+		p.priority[i] = PriorityNormal
+		if i < len(priorities) {
+			p.priority[i] = priorities[i]
+		}
+	}
+	p.countNeeded()
+}
+
+// Sets how pieces of the same priority are picked, where the playhead is the piece that the streaming
+// strategy picks in order from
+func (p *Picker) SetStrategy(strategy Strategy, playhead int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.strategy = strategy
+	p.playhead = playhead
+}
+
+// Helper function to pick the next needed piece that a peer has among the pieces of the highest priority,
+// as decided by the strategy, and mark it as in progress. Only pieces of a priority above the given one
+// are picked. Returns false if the peer has no such piece that we need
+func (p *Picker) pickPiece(bitfield []byte, above Priority) (int, bool) {
+	var candidates []int // In order
+	best := PrioritySkip
+	for i := range p.state {
+		if p.state[i] != pieceNeeded || !HavePiece(bitfield, i) || p.priority[i] < best || p.priority[i] <= above {
+			continue
+		}
+		if p.priority[i] > best {
+			best = p.priority[i]
+			candidates = candidates[:0]
+		}
+		candidates = append(candidates, i)
+	}
+	if len(candidates) == 0 {
+		return 0, false
+	}
+
+	index := -1
+	switch p.strategy {
+	case StrategySequential:
+		index = candidates[0]
+	case StrategyStreaming:
+		// The window starts at the first piece after the playhead that is not done yet
+		start := p.playhead
+		for start < len(p.state) && p.state[start] == pieceDone {
+			start++
+		}
+		window := int(max(streamingWindow/int64(p.torrent.PieceLength), 1))
+		for _, i := range candidates {
+			if i >= start && i < start+window {
+				index = i
+				break
+			}
+		}
+	}
+	if index < 0 {
+		index = p.rarest(candidates)
+	}
+	p.state[index] = pieceInProgress
+	p.picked++
+	return index, true
+}
+
+// Helper function to get the rarest of some pieces where ties are broken at random, the first few pieces
+// ignore rarity entirely so that we have something to share quickly
+func (p *Picker) rarest(candidates []int) int {
+	if p.picked < randomFirst {
+		return candidates[rand.Intn(len(candidates))]
+	}
+	var rarest []int
+	for _, i := range candidates {
+		if len(rarest) == 0 || p.availability[i] < p.availability[rarest[0]] {
+			rarest = append(rarest[:0], i)
+		} else if p.availability[i] == p.availability[rarest[0]] {
+			rarest = append(rarest, i)
+		}
+	}
+	return rarest[rand.Intn(len(rarest))]
+}
+
+// Helper function to mark a block as requested, which makes the peer the owner of a piece that is
+// being downloaded from a single peer
+func (p *Picker) request(index int, i int, peer string) Block {
+	partial := p.partial[index]
+	if partial.exclusive {
+		partial.owner = peer
+	}
+	if partial.blocks[i] == blockNeeded && p.priority[index] != PrioritySkip {
+		p.needed--
+	}
+	partial.blocks[i] = blockRequested
+	partial.requests[i]++
+	return p.block(index, i)
+}
+
+// Helper function to check whether a peer may download blocks of a piece
+func (partial *partialPiece) allows(peer string) bool {
+	return !partial.exclusive || partial.owner == "" || partial.owner == peer
+}
+
+// Helper function to get a block of a piece, the last block of a piece may be smaller
+func (p *Picker) block(index int, i int) Block {
+	begin := i * int(blockSize)
+	return Block{index, begin, min(int(blockSize), p.torrent.PieceSize(index)-begin)}
+}
+
+// Helper function to check if a list of blocks contains a specific block
+func containsBlock(blocks []Block, block Block) bool {
+	for i := range blocks {
+		if blocks[i] == block {
+			return true
+		}
+	}
+	return false
+}
+
+// Gives up on a requested block, which should be called when a peer disconnects or chokes us
+// The block can be picked again once every peer that requested it has given up
+func (p *Picker) ReleaseBlock(block Block) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	partial, ok := p.partial[block.Index]
+	if !ok {
+		return
+	}
+	i := block.Begin / int(blockSize)
+	partial.requests[i] = max(partial.requests[i]-1, 0)
+	if partial.blocks[i] == blockRequested && partial.requests[i] == 0 {
+		partial.blocks[i] = blockNeeded
+		if p.priority[block.Index] != PrioritySkip {
+			p.needed++
+		}
+	}
+
+	// A piece stops belonging to its owner once the owner has no requests left, such as after a choke
+	for i := range partial.requests {
+		if partial.requests[i] > 0 {
+			return
+		}
+	}
+	partial.owner = ""
+}
+
+// Stores a received block from a peer, which must match a block that was requested. Returns the data of
+// the piece once every block of the piece has been received, which must then be passed to FinishPiece
+func (p *Picker) AddBlock(block Block, data []byte, peer string) ([]byte, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	partial, ok := p.partial[block.Index]
+	if !ok || len(data) != block.Length || partial.blocks[block.Begin/int(blockSize)] == blockReceived {
+		p.wasted += int64(len(data)) // Another peer delivered the block first
+		return nil, false
+	}
+
+	i := block.Begin / int(blockSize)
+	copy(partial.data[block.Begin:], data)
+	if partial.blocks[i] == blockNeeded && p.priority[block.Index] != PrioritySkip {
+		p.needed-- // A block that was given up on can still arrive
+	}
+	partial.blocks[i] = blockReceived
+	partial.sources[i] = peer
+	partial.received++
+	if partial.received < len(partial.blocks) {
+		return nil, false
+	}
+	return partial.data, true
+}
+
+// The outcome of checking a piece, which names the peers that delivered its blocks
+type Verdict struct {
+	Valid    bool
+	Peers    []string // Every peer that delivered a block of the piece
+	Culprits []string // Peers that are known to have delivered bad blocks
+}
+
+// Completes a piece once every block has been received, an invalid piece has every block requested again
+// from a single peer. When the piece is valid, blocks that differ from a failed attempt reveal the peers
+// that sent bad data, which is known as smart banning
+func (p *Picker) FinishPiece(index int, valid bool) Verdict {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	partial, ok := p.partial[index]
+	if !ok {
+		return Verdict{}
+	}
+	verdict := Verdict{valid, uniqueSources(partial.sources), nil}
+
+	if !valid {
+		if len(verdict.Peers) == 1 {
+			verdict.Culprits = verdict.Peers // Every block came from the same peer
+		} else if partial.suspect == nil {
+			partial.suspect = make([][]byte, len(partial.blocks))
+			for i := range partial.blocks {
+				partial.suspect[i] = GetHash(partial.blockData(i))
+			}
+			partial.suspectSources = partial.sources
+		}
+		clear(partial.blocks)
+		clear(partial.requests)
+		if p.priority[index] != PrioritySkip {
+			p.needed += len(partial.blocks)
+		}
+		partial.sources = make([]string, len(partial.blocks))
+		partial.received = 0
+		partial.exclusive = true
+		partial.owner = ""
+		return verdict
+	}
+
+	if partial.suspect != nil {
+		var culprits []string
+		for i := range partial.blocks {
+			if !bytes.Equal(GetHash(partial.blockData(i)), partial.suspect[i]) {
+				culprits = append(culprits, partial.suspectSources[i])
+			}
+		}
+		verdict.Culprits = uniqueSources(culprits)
+	}
+	delete(p.partial, index)
+	p.state[index] = pieceDone
+	return verdict
+}
+
+// Helper function to get the data of a block of a piece that is in progress
+func (partial *partialPiece) blockData(i int) []byte {
+	begin := i * int(blockSize)
+	return partial.data[begin:min(begin+int(blockSize), len(partial.data))]
+}
+
+// Helper function to get every distinct peer in a list of peers, ignoring empty entries
+func uniqueSources(sources []string) []string {
+	var res []string
+	for _, source := range sources {
+		if source != "" && !containsString(res, source) {
+			res = append(res, source)
+		}
+	}
+	return res
+}
+
+// Helper function to check if a list of strings contains a specific string
+func containsString(list []string, value string) bool {
+	for i := range list {
+		if list[i] == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks whether a block no longer needs to be downloaded by a peer that requested it
+func (p *Picker) BlockReceived(block Block) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.state[block.Index] == pieceDone {
+		return true
+	}
+	partial, ok := p.partial[block.Index]
+	return ok && partial.blocks[block.Begin/int(blockSize)] == blockReceived
+}
+
+// Counts bytes that were received but thrown away, such as blocks that arrive after being cancelled
+func (p *Picker) AddWasted(length int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.wasted += int64(length)
+}
+
+// Gets the number of bytes that were wasted by endgame
+func (p *Picker) Wasted() int64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.wasted
+}
+
+// Checks whether every piece is done apart from skipped pieces
+func (p *Picker) Finished() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for i := range p.state {
+		if p.state[i] != pieceDone && p.priority[i] != PrioritySkip {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,236 @@
+package torrent
+
+import "testing"
+
+// Helper function to build a torrent with the given number of pieces that are each two blocks long
+func pickerTorrent(pieces int) *Torrent {
+	return &Torrent{
+		PieceHashes: make([][]byte, pieces),
+		PieceLength: 2 * blockSize,
+		Length:      uint32(pieces) * 2 * blockSize,
+	}
+}
+
+func TestPicker(t *testing.T) {
+	picker := NewPicker(pickerTorrent(8), []bool{true})
+	picker.picked = randomFirst // Skip the random first pieces
+
+	// Piece 0 is already complete and piece 2 is only held by a single peer
+	picker.AddBitfield([]byte{0b11111111})
+	picker.AddBitfield([]byte{0b11011111})
+	block, ok := picker.PickBlock([]byte{0b11111111}, nil, "a")
+	if !ok || block != (Block{2, 0, int(blockSize)}) {
+		t.Errorf("expected: first block of rarest piece %d -> got: %v", 2, block)
+	}
+
+	// Pieces that a peer does not have are never picked, and a released block keeps the piece in progress
+	bitfield := []byte{0b00100000}
+	other, _ := picker.PickBlock(bitfield, nil, "a")
+	if other != (Block{2, int(blockSize), int(blockSize)}) {
+		t.Errorf("expected: second block of piece %d -> got: %v", 2, other)
+	}
+	picker.ReleaseBlock(block)
+	if again, ok := picker.PickBlock(bitfield, []Block{other}, "a"); !ok || again != block {
+		t.Errorf("expected: released block %v -> got: %v", block, again)
+	}
+
+	// Blocks from several peers make up a piece, and blocks that do not match their request are rejected
+	if _, complete := picker.AddBlock(block, make([]byte, 10), "a"); complete {
+		t.Errorf("expected: block with the wrong length to be rejected")
+	}
+	picker.AddBlock(block, make([]byte, blockSize), "a")
+	data, complete := picker.AddBlock(other, make([]byte, blockSize), "a")
+	if !complete || len(data) != int(2*blockSize) {
+		t.Fatalf("expected: piece %d to be complete", 2)
+	}
+	if _, complete := picker.AddBlock(other, make([]byte, blockSize), "a"); complete || picker.Wasted() != 10+int64(blockSize) {
+		t.Errorf("expected: duplicate block to be wasted -> got: %d", picker.Wasted())
+	}
+
+	// An invalid piece is downloaded again
+	picker.FinishPiece(2, false)
+	if again, _ := picker.PickBlock(bitfield, nil, "a"); again != block {
+		t.Errorf("expected: block %v of invalid piece -> got: %v", block, again)
+	}
+
+	// A have message makes a piece less rare
+	SetPiece(bitfield, 7)
+	if !HavePiece(bitfield, 7) {
+		t.Errorf("expected: piece %d to be set", 7)
+	}
+	picker.AddHave(7)
+	picker.RemoveBitfield([]byte{0b11011111})
+	for i := range 6 {
+		block, ok := picker.PickBlock([]byte{0b11011111}, nil, "a")
+		if !ok || (block.Index == 7) != (i == 5) || block.Begin != 0 {
+			t.Errorf("expected: piece %d to be picked last -> got: %v", 7, block)
+		}
+		picker.FinishPiece(block.Index, true)
+	}
+}
+
+func TestPickerEndgame(t *testing.T) {
+	picker := NewPicker(pickerTorrent(1), nil)
+	bitfield := []byte{0b10000000}
+	first, _ := picker.PickBlock(bitfield, nil, "a")
+	second, _ := picker.PickBlock(bitfield, []Block{first}, "a")
+
+	// Every block is requested, so blocks are requested again from another peer
+	duplicate, ok := picker.PickBlock(bitfield, nil, "b")
+	if !ok || duplicate != first && duplicate != second {
+		t.Fatalf("expected: duplicate block -> got: %v", duplicate)
+	}
+	if _, ok := picker.PickBlock(bitfield, []Block{first, second}, "a"); ok {
+		t.Errorf("expected: no block for a peer that requested every block")
+	}
+
+	// Once a block arrives, every other peer that requested it should cancel
+	picker.AddBlock(duplicate, make([]byte, blockSize), "b")
+	if !picker.BlockReceived(duplicate) {
+		t.Errorf("expected: block %v to be received", duplicate)
+	}
+	remaining := first
+	if duplicate == first {
+		remaining = second
+	}
+	data, complete := picker.AddBlock(remaining, make([]byte, blockSize), "a")
+	if !complete || !picker.FinishPiece(0, true).Valid || !picker.Finished() || len(data) != int(2*blockSize) {
+		t.Errorf("expected: picker to be finished")
+	}
+}
+
+func TestPickerEndgameWaits(t *testing.T) {
+	picker := NewPicker(pickerTorrent(2), nil)
+	sparse := []byte{0b10000000}
+	first, _ := picker.PickBlock(sparse, nil, "a")
+	second, _ := picker.PickBlock(sparse, []Block{first}, "a")
+	if first.Index != 0 || second.Index != 0 {
+		t.Fatalf("expected: blocks of piece %d -> got: %v %v", 0, first, second)
+	}
+
+	// Another piece is still unrequested, so a peer that only has the first piece gets nothing
+	if block, ok := picker.PickBlock(sparse, nil, "b"); ok {
+		t.Errorf("expected: no duplicate before endgame -> got: %v", block)
+	}
+
+	// Once the other piece is requested as well, endgame begins
+	full := []byte{0b11000000}
+	third, _ := picker.PickBlock(full, nil, "c")
+	picker.PickBlock(full, []Block{third}, "c")
+	if block, ok := picker.PickBlock(sparse, nil, "b"); !ok || block.Index != 0 {
+		t.Errorf("expected: duplicate block of piece %d -> got: %v", 0, block)
+	}
+
+	// A block that is given up on has to be requested again before endgame continues
+	picker.ReleaseBlock(third)
+	if block, ok := picker.PickBlock(sparse, nil, "d"); ok {
+		t.Errorf("expected: no duplicate while a block is unrequested -> got: %v", block)
+	}
+	if block, ok := picker.PickBlock(full, nil, "d"); !ok || block != third {
+		t.Errorf("expected: block %v -> got: %v", third, block)
+	}
+}
+
+func TestPickerPriority(t *testing.T) {
+	picker := NewPicker(pickerTorrent(8), nil)
+	picker.picked = randomFirst
+	bitfield := []byte{0b11111111}
+	picker.AddBitfield(bitfield)
+	picker.AddBitfield([]byte{0b11111110})
+
+	// Pieces of priority now are picked in order before the rarest piece, and before pieces that are in progress
+	now := []Priority{PriorityNormal, PriorityNormal, PriorityNormal, PriorityNormal, PriorityNormal, PriorityNow, PriorityNow}
+	picker.SetPriorities(now)
+	for _, expected := range []Block{{5, 0, int(blockSize)}, {5, int(blockSize), int(blockSize)}, {6, 0, int(blockSize)}} {
+		if block, ok := picker.PickBlock(bitfield, nil, "a"); !ok || block != expected {
+			t.Errorf("expected: block %v of priority now -> got: %v", expected, block)
+		}
+	}
+	picker.SetPriorities(nil)
+	if block, _ := picker.PickBlock(bitfield, nil, "a"); block != (Block{6, int(blockSize), int(blockSize)}) {
+		t.Errorf("expected: block of piece in progress %d -> got: %v", 6, block)
+	}
+	if block, _ := picker.PickBlock(bitfield, nil, "a"); block.Index != 7 {
+		t.Errorf("expected: rarest piece %d -> got: %v", 7, block)
+	}
+
+	// A higher priority wins over rarity, and skipped pieces are never picked nor needed to finish
+	picker = NewPicker(pickerTorrent(4), []bool{false, false, false, true})
+	picker.picked = randomFirst
+	picker.AddBitfield([]byte{0b01000000})
+	picker.SetPriorities([]Priority{PrioritySkip, PriorityLow, PriorityHigh})
+	for _, expected := range []int{2, 1} {
+		block, ok := picker.PickBlock(bitfield, nil, "a")
+		if !ok || block.Index != expected {
+			t.Fatalf("expected: piece %d -> got: %v", expected, block)
+		}
+		picker.AddBlock(block, make([]byte, blockSize), "a")
+		picker.AddBlock(picker.block(expected, 1), make([]byte, blockSize), "a")
+		picker.FinishPiece(expected, true)
+	}
+	if block, ok := picker.PickBlock(bitfield, nil, "a"); ok || !picker.Finished() {
+		t.Errorf("expected: picker to be finished without skipped piece -> got: %v", block)
+	}
+}
+
+func TestPickerStrategy(t *testing.T) {
+	torr := pickerTorrent(300) // Pieces of 32 KiB, so the streaming window is 256 pieces long
+	bitfield := make([]byte, 38)
+	for i := range 300 {
+		SetPiece(bitfield, i)
+	}
+	for _, test := range []struct {
+		strategy Strategy
+		playhead int
+		done     []int
+		expected []int
+	}{
+		{StrategySequential, 0, []int{0, 1}, []int{2, 3, 4}},
+		{StrategyStreaming, 10, []int{10, 11}, []int{12, 13, 14}},
+		{StrategyStreaming, 299, []int{299}, nil}, // Nothing is left after the playhead, so rarest is used
+	} {
+		complete := make([]bool, 300)
+		for _, i := range test.done {
+			complete[i] = true
+		}
+		picker := NewPicker(torr, complete)
+		picker.picked = randomFirst
+		picker.SetStrategy(test.strategy, test.playhead)
+		for _, expected := range test.expected {
+			if index, _ := picker.pickPiece(bitfield, PrioritySkip); index != expected {
+				t.Errorf("expected: %s to pick piece %d -> got: %d", test.strategy, expected, index)
+			}
+		}
+		if test.expected == nil {
+			if index, ok := picker.pickPiece(bitfield, PrioritySkip); !ok || complete[index] {
+				t.Errorf("expected: %s to pick a missing piece -> got: %d", test.strategy, index)
+			}
+		}
+	}
+}
+
+func TestPickerPriorityInProgress(t *testing.T) {
+	picker := NewPicker(pickerTorrent(2), nil)
+	picker.picked = randomFirst
+	bitfield := []byte{0b11000000}
+	picker.AddBitfield(bitfield)
+	picker.SetPriorities([]Priority{PriorityNormal, PrioritySkip})
+	if block, _ := picker.PickBlock(bitfield, nil, "a"); block.Index != 0 {
+		t.Fatalf("expected: piece %d -> got: %v", 0, block)
+	}
+
+	// A needed piece of a higher priority is started before a piece in progress is finished
+	picker.SetPriorities([]Priority{PriorityLow, PriorityHigh})
+	for _, expected := range []Block{{1, 0, int(blockSize)}, {1, int(blockSize), int(blockSize)}, {0, int(blockSize), int(blockSize)}} {
+		if block, ok := picker.PickBlock(bitfield, nil, "a"); !ok || block != expected {
+			t.Errorf("expected: block %v -> got: %v", expected, block)
+		}
+	}
+
+	// Endgame prefers the higher priority even when its blocks have more requests
+	picker.request(1, 0, "c")
+	picker.request(1, 1, "c")
+	if block, ok := picker.PickBlock(bitfield, nil, "b"); !ok || block.Index != 1 {
+		t.Errorf("expected: endgame block of piece %d -> got: %v", 1, block)
+	}
+}
@@ -2,8 +2,11 @@ package torrent
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"time"
 )
@@ -18,14 +21,18 @@ type Message struct {
 	Payload []byte
 }
 
-// A structure to hold the state of our current download
+// A structure to hold the state of our current download from a peer
 type State struct {
-	Choked     bool
-	Downloaded int
-	Requested  int
-	Pending    int
-	Piece      []byte
-	Bitfield   []byte
+	Choked   bool
+	Requests []Block // Blocks that have been requested but not yet received
+	Bitfield []byte
+	Picker   *Picker
+	Pipeline *Pipeline
+	Client   string    // The client name a peer sent in its extended handshake
+	Peer     string    // The address of our peer, which is recorded against the blocks it delivers
+	Complete *Result   // A piece whose blocks have all been received, which is yet to be validated
+	Observer Observer  // Told about every block that is received, may be nil
+	Output   io.Writer // Where unexpected messages are printed, may be nil
 }
 
 const (
@@ -70,46 +77,142 @@ func ParseMessage(stream []byte) (Message, error) {
 func (m *Message) HandleMessage(state *State) {
 	switch m.Type {
 	case Choke:
+		// Pending requests are discarded by a peer that chokes us
 		state.Choked = true
+		for _, block := range state.Requests {
+			state.Picker.ReleaseBlock(block)
+			state.Pipeline.Forget(block)
+		}
+		state.Requests = nil
 	case Unchoke:
 		state.Choked = false
 	case Piece:
-		_, offset, block := ParsePiecePayload(m.Payload)
-		state.Pending--
-		state.Downloaded += len(block)
-		copy(state.Piece[offset:int(offset)+len(block)], block)
+		if len(m.Payload) < 8 {
+			return
+		}
+		index, begin, data := ParsePiecePayload(m.Payload)
+		block := Block{int(index), int(begin), len(data)}
+
+		// Only blocks that we requested are accepted, cancelled blocks may still arrive and are wasted
+		for i := range state.Requests {
+			if state.Requests[i] == block {
+				state.Requests = append(state.Requests[:i], state.Requests[i+1:]...)
+				state.Pipeline.Received(block, time.Now())
+				if state.Observer != nil {
+					state.Observer(Event{Type: EventBlockReceived, Piece: block.Index, Begin: block.Begin, BlockLength: block.Length})
+				}
+				piece, complete := state.Picker.AddBlock(block, data, state.Peer)
+				if complete {
+					state.Complete = &Result{block.Index, piece, Verdict{}, nil}
+				}
+				state.Picker.ReleaseBlock(block)
+				return
+			}
+		}
+		state.Picker.AddWasted(len(data))
+	case Bitfield:
+		// Peers that support extensions may send their extended handshake before the bitfield, so only
+		// the pieces that no have message told us about yet are added to the picker
+		if len(m.Payload) != len(state.Bitfield) {
+			return
+		}
+		added := make([]byte, len(m.Payload))
+		for i := range m.Payload {
+			added[i] = m.Payload[i] &^ state.Bitfield[i]
+			state.Bitfield[i] |= m.Payload[i]
+		}
+		state.Picker.AddBitfield(added)
 	case Have:
+		if len(m.Payload) < 4 {
+			return
+		}
 		index := ParseHavePayload(m.Payload)
-		SetPiece(state.Bitfield, int(index))
+		if !HavePiece(state.Bitfield, int(index)) {
+			SetPiece(state.Bitfield, int(index))
+			state.Picker.AddHave(int(index))
+		}
+	case Extended:
+		// Only the extended handshake is understood, which may limit our outstanding requests
+		if len(m.Payload) > 0 && m.Payload[0] == extendedHandshake {
+			handshake, err := ParseExtendedHandshake(m.Payload)
+			if err != nil {
+				return
+			}
+			state.Pipeline.SetLimit(handshake.Reqq)
+			state.Client = handshake.Client
+		}
 	// We are not expecting any of the cases below but they're illustrated for completeness
 	default:
-		fmt.Printf("invalid message: %x \n", m.Type)
+		if state.Output != nil {
+			fmt.Fprintf(state.Output, "invalid message: %x \n", m.Type)
+		}
 	}
 }
 
-// Downloads a piece by communicating with a specified peer
-// All integers sent through the BitTorrent protocol are encoded as 4 bytes big endian
-func (t *Torrent) PieceWorker(peer Peer, peerId []byte, workQueue chan *Work, resQueue chan *Result) error {
-	// Do handshake
-	conn, _, err := peer.PeerHandshake(t.InfoHash, peerId)
-	if err != nil {
-		fmt.Println(err)
-		return err
+const statsInterval = 2 * time.Second // How often the rates of a peer are reported
+
+// A connection that counts the bytes read and written, which is only used by a single worker
+type countingConn struct {
+	net.Conn
+	read    int64
+	written int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read += int64(n)
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written += int64(n)
+	return n, err
+}
+
+// Downloads pieces by communicating with a peer that we have done the handshake with, the picker decides
+// which pieces are downloaded and the reputation decides whether the peer is still trusted. Cancelling
+// ctx closes the connection, which makes the worker return. The observer, which may be nil, is told about
+// requests, blocks and the rates of the peer, and errors are printed to output. All integers sent through
+// the BitTorrent protocol are encoded as 4 bytes big endian
+func (t *Torrent) PieceWorker(ctx context.Context, conn net.Conn, handshake Handshake, picker *Picker,
+	reputation *Reputation, resQueue chan *Result, observer Observer, output io.Writer) error {
+	counter := &countingConn{Conn: conn}
+	conn = counter
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	address := conn.RemoteAddr().String()
+	notify := func(event Event) {
+		if observer != nil {
+			event.Peer = address
+			observer(event)
+		}
+	}
+	defer stop()
+	if SupportsExtensions(handshake.Extensions) {
+		extended := BuildExtendedHandshake()
+		conn.Write(extended.BuildMessage())
 	}
 
-	// Read bitfield and initialize the initial state of our peer
+	// Read the first message, which is usually the bitfield, and initialize the initial state of our peer
 	buf, err := ReadFullWithLength(conn, 4, 0)
 	if err != nil {
-		fmt.Println(err)
+		fmt.Fprintln(output, err)
 		return err
 	}
 	msg, err := ParseMessage(buf)
 	if err != nil {
-		fmt.Println(err)
+		fmt.Fprintln(output, err)
 		return err
 	}
-	var bitfield []byte = msg.Payload
-	state := State{true, 0, 0, 0, nil, bitfield}
+	bitfield := make([]byte, (len(t.PieceHashes)+7)/8)
+	peer := PeerAddress(conn.RemoteAddr())
+	state := State{Choked: true, Bitfield: bitfield, Picker: picker, Pipeline: NewPipeline(), Peer: peer, Observer: notify, Output: output}
+	defer picker.RemoveBitfield(bitfield) // Includes any pieces added by bitfield and have messages
+
+	// Peers without any pieces may skip the bitfield entirely
+	if msg.Length != 0 {
+		msg.HandleMessage(&state)
+	}
 
 	// Write interested and unchoked, since connections start choked and uninterested
 	interested := Message{1, Interested, nil}
@@ -117,99 +220,179 @@ func (t *Torrent) PieceWorker(peer Peer, peerId []byte, workQueue chan *Work, re
 	conn.Write(interested.BuildMessage())
 	conn.Write(unchoke.BuildMessage())
 
-	// Attempt to download a piece from the work queue
-	for work := range workQueue {
-		// Make sure our peer has the specific piece
-		if !HavePiece(bitfield, work.Index) {
-			workQueue <- work // Place work back on queue
-			continue
+	// Release any blocks still requested once our peer disconnects, their progress is kept by the picker
+	defer func() {
+		for _, block := range state.Requests {
+			picker.ReleaseBlock(block)
+		}
+	}()
+
+	// Download blocks of the rarest pieces that our peer has until every piece is done
+	started := make(map[int]bool) // Pieces that our peer was asked for
+	var lastStats time.Time
+	var lastRead, lastWritten int64
+	var lastClient string
+	for !picker.Finished() {
+		if now := time.Now(); now.Sub(lastStats) >= statsInterval || state.Client != lastClient {
+			// The first rates are zero since the time since the zero time is so long
+			elapsed := max(now.Sub(lastStats).Seconds(), 0.001)
+			notify(Event{Type: EventPeerStats, Client: state.Client,
+				DownloadRate: int(float64(counter.read-lastRead) / elapsed),
+				UploadRate:   int(float64(counter.written-lastWritten) / elapsed)})
+			lastStats, lastRead, lastWritten, lastClient = now, counter.read, counter.written, state.Client
+		}
+
+		// Our peer may be banned because of a piece that another peer finished
+		if reputation.Banned(peer) {
+			return &NetworkError{"peer is banned: " + peer}
+		}
+		CancelReceived(conn, &state)
+
+		// Keep the pipeline of requests full while we are unchoked, its depth adapts to our peer
+		for !state.Choked && len(state.Requests) < state.Pipeline.Depth() {
+			block, ok := picker.PickBlock(bitfield, state.Requests, peer)
+			if !ok {
+				break
+			}
+			requestPayload := BuildRequestPayload(uint32(block.Index), uint32(block.Begin), uint32(block.Length))
+			request := Message{uint32(requestLength + 1), Request, requestPayload}
+			conn.Write(request.BuildMessage())
+			state.Requests = append(state.Requests, block)
+			state.Pipeline.Sent(block, time.Now())
+			if !started[block.Index] {
+				started[block.Index] = true
+				notify(Event{Type: EventPieceRequested, Piece: block.Index})
+			}
 		}
 
-		piece, err := t.DownloadBlock(conn, work, &state)
+		if len(state.Requests) == 0 {
+			// Our peer has nothing we need right now or is choking us, so wait for that to change
+			err = t.WaitForMessage(conn, &state)
+		} else {
+			err = t.ReadMessage(conn, &state)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		if err != nil {
-			workQueue <- work // Place work back on queue
-			fmt.Println("exiting with: " + err.Error())
+			fmt.Fprintln(output, "exiting with: "+err.Error())
 			return err
 		}
-
-		// Make sure piece matches SHA-1 hash
-		if !t.ValidatePiece(piece, work.Index) {
-			workQueue <- work // Place work back on queue
-			fmt.Println("failed integrity check")
+		if state.Complete == nil {
 			continue
 		}
 
-		// Piece is complete and valid, place on to the results queue
-		bufHave := make([]byte, 4)
-		binary.BigEndian.PutUint32(bufHave, uint32(work.Index))
-		have := Message{5, Have, bufHave}
-		conn.Write(have.BuildMessage())
-		resQueue <- &Result{work.Index, piece}
+		// Make sure piece matches its hash, an invalid piece has every block requested again and counts
+		// against every peer that delivered a block of it
+		res := state.Complete
+		state.Complete = nil
+		delete(started, res.Index)
+		res.Verdict = picker.FinishPiece(res.Index, t.ValidatePiece(res.Result, res.Index))
+		res.Banned = reputation.Record(res.Verdict)
+		if res.Verdict.Valid {
+			bufHave := make([]byte, 4)
+			binary.BigEndian.PutUint32(bufHave, uint32(res.Index))
+			have := Message{5, Have, bufHave}
+			conn.Write(have.BuildMessage())
+		}
+
+		// Place the piece on to the results queue, invalid pieces are only reported
+		select {
+		case resQueue <- res:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 	return nil
 }
 
-const maxPending = 5  // Max number of pending requests allowed
-const maxSeconds = 30 // Max number of seconds allowed to download a piece
+const idleSeconds = 5 // Max number of seconds to wait for a message while a peer has nothing we need
 
-// Helper function to download the blocks of a piece. When calling this function, the peer should
-// must be able to communicate via request and piece messages (i.e. overhead and setup is already handled)
-func (t *Torrent) DownloadBlock(conn net.Conn, work *Work, state *State) ([]byte, error) {
-	// Handle the current state of the connection through a structure
-	state.Piece = make([]byte, work.Length)
-	state.Downloaded = 0
-	state.Requested = 0
-	state.Pending = 0
+// Helper function to wait for a single message from an idle peer, which is how have messages are received
+// when there is nothing to download. It is not an error for no message to arrive
+func (t *Torrent) WaitForMessage(conn net.Conn, state *State) error {
+	conn.SetReadDeadline(time.Now().Add(time.Second * idleSeconds))
+	defer conn.SetReadDeadline(time.Time{})
 
-	conn.SetDeadline(time.Now().Add(time.Second * maxSeconds))
-	defer conn.SetDeadline(time.Time{}) // Want to keep our connection on success
+	// Only the length prefix may time out, otherwise the rest of the message would be lost
+	prefix := make([]byte, lengthSize)
+	n, err := io.ReadFull(conn, prefix)
+	var netErr net.Error
+	if n == 0 && errors.As(err, &netErr) && netErr.Timeout() {
+		return nil
+	}
+	if err != nil {
+		return &NetworkError{"failed to read from peer: " + err.Error()}
+	}
 
-	for uint32(state.Downloaded) < uint32(work.Length) {
-		if !state.Choked {
-			for state.Pending < maxPending && state.Requested <= work.Length/int(blockSize) {
-				requestPayload := BuildRequestPayload(uint32(state.Requested), uint32(work.Length), uint32(work.Index))
+	length := binary.BigEndian.Uint32(prefix)
+	if length > maxMessageSize {
+		return &NetworkError{fmt.Sprintf("peer sent a message of %d bytes, which is too large", length)}
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second * maxSeconds))
+	buf := make([]byte, length)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		return &NetworkError{"failed to read from peer: " + err.Error()}
+	}
+	msg, err := ParseMessage(append(prefix, buf...))
+	if err != nil {
+		return err
+	}
+	if msg.Length != 0 {
+		msg.HandleMessage(state)
+	}
+	return nil
+}
 
-				// Write request
-				request := Message{uint32(requestLength + 1), Request, requestPayload}
-				conn.Write(request.BuildMessage())
+const maxSeconds = 30 // Max number of seconds allowed to wait for a requested block
 
-				// Update state
-				state.Pending++
-				state.Requested++
-			}
-		}
+// Helper function to read a single message from a peer that has pending requests
+func (t *Torrent) ReadMessage(conn net.Conn, state *State) error {
+	conn.SetReadDeadline(time.Now().Add(time.Second * maxSeconds))
+	defer conn.SetReadDeadline(time.Time{}) // Want to keep our connection on success
 
-		// Read piece
-		buf, err := ReadFullWithLength(conn, 4, 0)
-		if err != nil {
-			return []byte{}, err
-		}
-		msg, err := ParseMessage(buf)
-		if err != nil {
-			return []byte{}, err
-		}
-		if msg.Length != 0 {
-			msg.HandleMessage(state)
-		}
+	buf, err := ReadFullWithLength(conn, 4, 0)
+	if err != nil {
+		return err
 	}
+	msg, err := ParseMessage(buf)
+	if err != nil {
+		return err
+	}
+	if msg.Length != 0 {
+		msg.HandleMessage(state)
+	}
+	return nil
+}
 
-	return state.Piece, nil
+// Helper function to send cancel messages for every requested block that another peer delivered first,
+// which happens during endgame
+func CancelReceived(conn net.Conn, state *State) {
+	requests := state.Requests[:0]
+	for _, block := range state.Requests {
+		if !state.Picker.BlockReceived(block) {
+			requests = append(requests, block)
+			continue
+		}
+		// Cancel messages share the payload of the request they cancel
+		cancelPayload := BuildRequestPayload(uint32(block.Index), uint32(block.Begin), uint32(block.Length))
+		cancel := Message{uint32(requestLength + 1), Cancel, cancelPayload}
+		conn.Write(cancel.BuildMessage())
+		state.Picker.ReleaseBlock(block)
+		state.Pipeline.Forget(block)
+	}
+	state.Requests = requests
 }
 
-// Helper function to handle request payloads
-func BuildRequestPayload(i uint32, pieceLength uint32, pieceIndex uint32) []byte {
+// Helper function to handle request payloads, which are shared by cancel messages
+func BuildRequestPayload(index uint32, begin uint32, length uint32) []byte {
 	requestPayload := make([]byte, requestLength)
 
-	// Get size and reduce if necessary (can occur on last block of data)
-	var size uint32 = blockSize
-	if pieceLength-i*blockSize < blockSize {
-		size = pieceLength - i*blockSize
-	}
-
 	// Populate payload
-	binary.BigEndian.PutUint32(requestPayload, pieceIndex)
-	binary.BigEndian.PutUint32(requestPayload[4:], i*blockSize)
-	binary.BigEndian.PutUint32(requestPayload[8:], size)
+	binary.BigEndian.PutUint32(requestPayload, index)
+	binary.BigEndian.PutUint32(requestPayload[4:], begin)
+	binary.BigEndian.PutUint32(requestPayload[8:], length)
 
 	return requestPayload
 }
@@ -231,6 +414,9 @@ func ParseHavePayload(payload []byte) uint32 {
 
 // Helper function to check if a hash of a downloaded piece is valid
 func (t *Torrent) ValidatePiece(piece []byte, index int) bool {
+	if t.V2Only() {
+		return t.validatePieceV2(piece, index)
+	}
 	hash := GetHash(piece)
 	return bytes.Equal(hash, t.PieceHashes[index])
 }
@@ -239,6 +425,9 @@ func (t *Torrent) ValidatePiece(piece []byte, index int) bool {
 func HavePiece(bitfield []byte, index int) bool {
 	byteIndex := index / 8
 	byteOffset := index % 8
+	if index < 0 || byteIndex >= len(bitfield) {
+		return false
+	}
 	return bitfield[byteIndex]>>(7-byteOffset)&1 != 0
 }
 
@@ -246,5 +435,8 @@ func HavePiece(bitfield []byte, index int) bool {
 func SetPiece(bitfield []byte, index int) {
 	byteIndex := index / 8
 	byteOffset := index % 8
-	bitfield[byteIndex] |= 1 >> (7 - byteOffset)
+	if index < 0 || byteIndex >= len(bitfield) {
+		return
+	}
+	bitfield[byteIndex] |= 1 << (7 - byteOffset)
 }
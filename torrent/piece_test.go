@@ -0,0 +1,129 @@
+package torrent
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Helper function to act as a peer that has every piece and answers every request with zeros
+func fakeSeeder(conn net.Conn, pieces int) {
+	bitfield := make([]byte, (pieces+7)/8)
+	for i := range pieces {
+		SetPiece(bitfield, i)
+	}
+	msg := Message{uint32(len(bitfield) + 1), Bitfield, bitfield}
+	conn.Write(msg.BuildMessage())
+	unchoke := Message{1, Unchoke, nil}
+	conn.Write(unchoke.BuildMessage())
+
+	for {
+		buf, err := ReadFullWithLength(conn, 4, 0)
+		if err != nil {
+			return
+		}
+		msg, err := ParseMessage(buf)
+		if err != nil || msg.Type != Request || len(msg.Payload) != requestLength {
+			continue
+		}
+		length := binary.BigEndian.Uint32(msg.Payload[8:])
+		payload := append(append([]byte{}, msg.Payload[:8]...), make([]byte, length)...)
+		piece := Message{uint32(len(payload) + 1), Piece, payload}
+		conn.Write(piece.BuildMessage())
+	}
+}
+
+func TestPieceWorkerCancel(t *testing.T) {
+	baseline := runtimeGoroutines()
+	torr := pickerTorrent(2)
+	for i := range torr.PieceHashes {
+		torr.PieceHashes[i] = GetHash(make([]byte, torr.PieceLength))
+	}
+	picker := NewPicker(torr, nil)
+	ours, theirs := net.Pipe()
+	go fakeSeeder(theirs, 2)
+
+	// Nobody reads the results, so the worker is stuck handing over a valid piece until it is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	resQueue := make(chan *Result)
+	done := make(chan error)
+	go func() {
+		done <- torr.PieceWorker(ctx, ours, Handshake{}, picker, NewReputation(), resQueue, nil, io.Discard)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("expected: %v -> got: %v", context.Canceled, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("worker did not return once cancelled")
+	}
+	ours.Close()
+	checkGoroutines(t, baseline)
+}
+
+func TestPieceWorkerExtendedFirst(t *testing.T) {
+	torr := pickerTorrent(2)
+	for i := range torr.PieceHashes {
+		torr.PieceHashes[i] = GetHash(make([]byte, torr.PieceLength))
+	}
+	picker := NewPicker(torr, nil)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Peers such as libtorrent send their extended handshake before the bitfield
+		extended := BuildExtendedHandshake()
+		conn.Write(extended.BuildMessage())
+		fakeSeeder(conn, 2)
+	}()
+	ours, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	extensions := make([]byte, extensionSize)
+	extensions[extensionByte] |= extensionBit
+	resQueue := make(chan *Result, 2)
+	go torr.PieceWorker(ctx, ours, Handshake{Extensions: extensions}, picker, NewReputation(), resQueue, nil, io.Discard)
+	select {
+	case res := <-resQueue:
+		if len(res.Result) != int(torr.PieceLength) {
+			t.Errorf("unexpected result: %+v", res)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected a piece from a peer whose bitfield follows its extended handshake")
+	}
+}
+
+func TestReadMessageTooLarge(t *testing.T) {
+	// A length prefix far above any real message is refused instead of being allocated
+	prefix := binary.BigEndian.AppendUint32(nil, 0xffffffff)
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	defer theirs.Close()
+	go theirs.Write(prefix)
+	if _, err := ReadFullWithLength(ours, 4, 0); err == nil {
+		t.Errorf("expected: error for a message that is too large")
+	}
+
+	go theirs.Write(prefix)
+	var torr Torrent
+	if err := torr.WaitForMessage(ours, &State{}); err == nil {
+		t.Errorf("expected: error for a message that is too large")
+	}
+}
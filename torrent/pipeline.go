@@ -0,0 +1,83 @@
+package torrent
+
+import (
+	"time"
+)
+
+const initialDepth int = 5 // Number of outstanding requests before anything has been measured
+const minDepth int = 2     // A slow peer always has a request queued behind the one being served
+const maxDepth int = 250   // Even the fastest peers never have more outstanding requests than this
+
+// Tracks the download rate and round-trip time of a peer to decide how many requests should be
+// outstanding at once. Enough requests are kept in flight to cover twice the bandwidth-delay product,
+// so a fast peer on a high-latency link is never left idle while a slow peer is not flooded
+type Pipeline struct {
+	rate        float64       // Bytes per second, smoothed over time
+	rtt         time.Duration // The lowest round-trip time seen, which excludes time spent queued at the peer
+	limit       int           // Number of outstanding requests the peer allows
+	windowStart time.Time
+	windowBytes int
+	sent        map[Block]time.Time
+}
+
+// Creates a pipeline for a peer that has not advertised a limit
+func NewPipeline() *Pipeline {
+	return &Pipeline{limit: defaultReqq, sent: make(map[Block]time.Time)}
+}
+
+// Sets the number of outstanding requests the peer allows, which is advertised as reqq
+func (p *Pipeline) SetLimit(reqq int) {
+	p.limit = max(reqq, 1)
+}
+
+// Records that a block was requested
+func (p *Pipeline) Sent(block Block, now time.Time) {
+	p.sent[block] = now
+	if p.windowStart.IsZero() {
+		p.windowStart = now
+	}
+}
+
+// Records that a block was received, updating the round-trip time and the download rate
+func (p *Pipeline) Received(block Block, now time.Time) {
+	if sent, ok := p.sent[block]; ok {
+		delete(p.sent, block)
+		if rtt := now.Sub(sent); p.rtt == 0 || rtt < p.rtt {
+			p.rtt = rtt
+		}
+	}
+
+	// The rate is sampled at most once a second so that it is not skewed by bursts
+	p.windowBytes += block.Length
+	elapsed := now.Sub(p.windowStart)
+	if elapsed < time.Second {
+		return
+	}
+	sample := float64(p.windowBytes) / elapsed.Seconds()
+	if p.rate == 0 {
+		p.rate = sample
+	} else {
+		p.rate = 0.7*p.rate + 0.3*sample
+	}
+	p.windowStart = now
+	p.windowBytes = 0
+}
+
+// Forgets a block that will never be received, such as one that was cancelled
+func (p *Pipeline) Forget(block Block) {
+	delete(p.sent, block)
+}
+
+// Gets the number of requests that should be outstanding
+func (p *Pipeline) Depth() int {
+	depth := initialDepth
+	if p.rate > 0 && p.rtt > 0 {
+		depth = int(2*p.rate*p.rtt.Seconds()/float64(blockSize)) + 1
+	}
+	return min(max(depth, minDepth), maxDepth, p.limit)
+}
+
+// Gets the download rate in bytes per second
+func (p *Pipeline) Rate() float64 {
+	return p.rate
+}
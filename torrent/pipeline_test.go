@@ -0,0 +1,63 @@
+package torrent
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPipeline(t *testing.T) {
+	pipeline := NewPipeline()
+	if depth := pipeline.Depth(); depth != initialDepth {
+		t.Errorf("expected: %d -> got: %d", initialDepth, depth)
+	}
+
+	// A fast peer with a high round-trip time: 1 MiB/s over 200 ms needs about 26 requests in flight
+	now := time.Now()
+	for i := 0; i < 64; i++ {
+		block := Block{0, i * int(blockSize), int(blockSize)}
+		pipeline.Sent(block, now)
+		now = now.Add(time.Second / 64)
+		pipeline.Received(block, now.Add(200*time.Millisecond-time.Second/64))
+	}
+	if depth := pipeline.Depth(); depth < 20 || depth > 30 {
+		t.Errorf("expected: around %d -> got: %d", 26, depth)
+	}
+
+	// An advertised reqq always bounds the depth
+	pipeline.SetLimit(10)
+	if depth := pipeline.Depth(); depth != 10 {
+		t.Errorf("expected: %d -> got: %d", 10, depth)
+	}
+
+	// A slow peer on a low-latency link still has a request queued
+	slow := NewPipeline()
+	first, second := Block{0, 0, int(blockSize)}, Block{0, int(blockSize), int(blockSize)}
+	slow.Sent(first, now)
+	slow.Received(first, now.Add(50*time.Millisecond))
+	slow.Sent(second, now.Add(950*time.Millisecond))
+	slow.Received(second, now.Add(time.Second))
+	if depth := slow.Depth(); depth != minDepth {
+		t.Errorf("expected: %d -> got: %d", minDepth, depth)
+	}
+}
+
+func TestParseExtendedHandshake(t *testing.T) {
+	bencode, _ := EncodeBencode(map[string]interface{}{
+		"m":    map[string]interface{}{"ut_pex": 1, "ut_metadata": 0},
+		"reqq": 500,
+		"v":    "test 1.0",
+	})
+	handshake, err := ParseExtendedHandshake(append([]byte{extendedHandshake}, bencode...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if handshake.Reqq != 500 || handshake.Client != "test 1.0" || handshake.Messages["ut_pex"] != 1 || len(handshake.Messages) != 1 {
+		t.Errorf("unexpected handshake: %+v", handshake)
+	}
+
+	msg := BuildExtendedHandshake()
+	handshake, err = ParseExtendedHandshake(msg.Payload)
+	if err != nil || handshake.Reqq != defaultReqq || handshake.Client != clientName {
+		t.Errorf("unexpected handshake: %+v (%v)", handshake, err)
+	}
+}
@@ -0,0 +1,71 @@
+package torrent
+
+import "fmt"
+
+// How a torrent picks its next piece among the pieces of the highest priority
+type Strategy string
+
+const (
+	StrategyRarest     Strategy = "rarest"     // The piece that the fewest peers have, which keeps the swarm healthy
+	StrategySequential Strategy = "sequential" // The first piece in order
+	StrategyStreaming  Strategy = "streaming"  // Pieces right after the playhead in order, the rarest piece otherwise
+)
+
+// Parses the name of a strategy, where an empty name is the default strategy
+func ParseStrategy(name string) (Strategy, error) {
+	switch Strategy(name) {
+	case "":
+		return StrategyRarest, nil
+	case StrategyRarest, StrategySequential, StrategyStreaming:
+		return Strategy(name), nil
+	}
+	return "", fmt.Errorf("unknown strategy: %s", name)
+}
+
+// The priority of a piece, where pieces of a higher priority are picked first and skipped pieces are never picked
+type Priority int
+
+const (
+	PrioritySkip Priority = iota
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+	PriorityNow // Picked in order before any other piece, such as the pieces that are being read
+)
+
+var priorityNames = []string{"skip", "low", "normal", "high", "now"}
+
+// Parses the name of a priority
+func ParsePriority(name string) (Priority, error) {
+	for i := range priorityNames {
+		if priorityNames[i] == name {
+			return Priority(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown priority: %s", name)
+}
+
+func (p Priority) String() string {
+	if p < PrioritySkip || p > PriorityNow {
+		return fmt.Sprintf("Priority(%d)", int(p))
+	}
+	return priorityNames[p]
+}
+
+// Encodes a priority as its name, such as in JSON
+func (p Priority) MarshalText() ([]byte, error) {
+	if p < PrioritySkip || p > PriorityNow {
+		return nil, fmt.Errorf("invalid priority: %d", int(p))
+	}
+	return []byte(p.String()), nil
+}
+
+// Decodes a priority from its name
+func (p *Priority) UnmarshalText(text []byte) error {
+	priority, err := ParsePriority(string(text))
+	if err != nil {
+		return err
+	}
+	*p = priority
+	return nil
+}
@@ -0,0 +1,274 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A token bucket which limits a rate in bytes per second, where the bucket holds up to a second of
+// tokens. Callers may take more tokens than are available, in which case they wait until the debt is
+// repaid, so large reads never block forever. A rate of zero is unlimited. It is safe for concurrent use
+type RateLimiter struct {
+	mutex  sync.Mutex
+	rate   int
+	tokens float64
+	last   time.Time
+}
+
+// Creates a rate limiter with a full bucket
+func NewRateLimiter(rate int) *RateLimiter {
+	return &RateLimiter{rate: max(rate, 0), tokens: float64(max(rate, 0)), last: time.Now()}
+}
+
+// Changes the rate of a limiter, which takes effect for every later call to Wait
+func (r *RateLimiter) SetRate(rate int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.refill(time.Now())
+	r.rate = max(rate, 0)
+	r.tokens = min(r.tokens, float64(r.rate))
+}
+
+// Gets the rate of a limiter in bytes per second, where zero is unlimited
+func (r *RateLimiter) Rate() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.rate
+}
+
+// Blocks until n bytes may be transferred, returns early with the error of ctx once it is cancelled
+func (r *RateLimiter) Wait(ctx context.Context, n int) error {
+	wait := r.reserve(n, time.Now())
+	if wait <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Takes n tokens without waiting, where any debt is repaid by the next call to Wait
+func (r *RateLimiter) Take(n int) {
+	r.reserve(n, time.Now())
+}
+
+// Helper function to take n tokens, returns the time to wait until the tokens are repaid
+func (r *RateLimiter) reserve(n int, now time.Time) time.Duration {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.rate == 0 {
+		return 0
+	}
+	r.refill(now)
+	r.tokens -= float64(n)
+	if r.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-r.tokens / float64(r.rate) * float64(time.Second))
+}
+
+// Helper function to add the tokens earned since the last refill
+func (r *RateLimiter) refill(now time.Time) {
+	if now.After(r.last) {
+		r.tokens = min(r.tokens+now.Sub(r.last).Seconds()*float64(r.rate), float64(r.rate))
+		r.last = now
+	}
+}
+
+// A pair of limiters for the download and upload rate
+type Limits struct {
+	Download *RateLimiter
+	Upload   *RateLimiter
+}
+
+// Creates limits where each rate is in bytes per second and zero is unlimited
+func NewLimits(download int, upload int) *Limits {
+	return &Limits{NewRateLimiter(download), NewRateLimiter(upload)}
+}
+
+// Changes both rates of the limits
+func (l *Limits) Set(download int, upload int) {
+	l.Download.SetRate(download)
+	l.Upload.SetRate(upload)
+}
+
+// A connection where reads and writes are limited by every set of limits, such as the limits of a
+// session and the limits of a torrent. Time spent waiting for tokens does not count towards the read deadline
+// and closing the connection stops any wait
+type limitedConn struct {
+	net.Conn
+	limits   []*Limits
+	mutex    sync.Mutex
+	deadline time.Time // The read deadline as set by the caller, moved back by every wait
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// Wraps a connection so that it is limited by every set of limits, nil limits are ignored
+func LimitConn(conn net.Conn, limits ...*Limits) net.Conn {
+	ctx, cancel := context.WithCancel(context.Background())
+	res := limitedConn{Conn: conn, ctx: ctx, cancel: cancel}
+	for _, l := range limits {
+		if l != nil {
+			res.limits = append(res.limits, l)
+		}
+	}
+	return &res
+}
+
+// Waits until the bytes of earlier reads are allowed, then reads from the connection. The bytes that
+// were read are taken without waiting, so a read never times out because of the limits
+func (c *limitedConn) Read(b []byte) (int, error) {
+	start := time.Now()
+	for _, l := range c.limits {
+		if l.Download.Wait(c.ctx, 0) != nil {
+			return 0, net.ErrClosed
+		}
+	}
+	if waited := time.Since(start); waited > time.Millisecond {
+		c.mutex.Lock()
+		if !c.deadline.IsZero() {
+			c.deadline = c.deadline.Add(waited)
+			c.Conn.SetReadDeadline(c.deadline)
+		}
+		c.mutex.Unlock()
+	}
+	n, err := c.Conn.Read(b)
+	for _, l := range c.limits {
+		l.Download.Take(n)
+	}
+	return n, err
+}
+
+// Sets the read and write deadlines, where the read deadline is kept so that it can be moved back
+func (c *limitedConn) SetDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.deadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+// Sets the read deadline, which is moved back by any time spent waiting for tokens
+func (c *limitedConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.deadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// Waits until the bytes may be written, then writes to the connection
+func (c *limitedConn) Write(b []byte) (int, error) {
+	for _, l := range c.limits {
+		if l.Upload.Wait(c.ctx, len(b)) != nil {
+			return 0, net.ErrClosed
+		}
+	}
+	return c.Conn.Write(b)
+}
+
+// Closes the connection, which stops any read or write that is waiting for tokens
+func (c *limitedConn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
+
+// A time of day where different rates apply, such as slower rates during work hours. A rule where the
+// start is after the end wraps past midnight
+type ScheduleRule struct {
+	Weekdays bool // Whether the rule only applies from Monday to Friday
+	Start    int  // Minutes after midnight
+	End      int
+	Download int // Bytes per second, where zero is unlimited
+	Upload   int
+}
+
+// A list of rules, where the first rule that applies decides the rates
+type Schedule []ScheduleRule
+
+// Parses a rule of the form [weekdays ]HH:MM-HH:MM=<download>/<upload>, where rates are in KiB/s
+func ParseScheduleRule(text string) (ScheduleRule, error) {
+	var rule ScheduleRule
+	text = strings.TrimSpace(text)
+	if rest, found := strings.CutPrefix(text, "weekdays "); found {
+		rule.Weekdays = true
+		text = strings.TrimSpace(rest)
+	}
+	times, rates, found := strings.Cut(text, "=")
+	start, end, found2 := strings.Cut(times, "-")
+	download, upload, found3 := strings.Cut(rates, "/")
+	if !found || !found2 || !found3 {
+		return ScheduleRule{}, fmt.Errorf("schedule rule must look like [weekdays ]HH:MM-HH:MM=<download>/<upload>")
+	}
+
+	var err error
+	if rule.Start, err = parseClock(start); err != nil {
+		return ScheduleRule{}, err
+	}
+	if rule.End, err = parseClock(end); err != nil {
+		return ScheduleRule{}, err
+	}
+	if rule.Download, err = strconv.Atoi(download); err != nil || rule.Download < 0 {
+		return ScheduleRule{}, fmt.Errorf("invalid download rate: %s", download)
+	}
+	if rule.Upload, err = strconv.Atoi(upload); err != nil || rule.Upload < 0 {
+		return ScheduleRule{}, fmt.Errorf("invalid upload rate: %s", upload)
+	}
+	rule.Download *= 1024
+	rule.Upload *= 1024
+	return rule, nil
+}
+
+// Helper function to parse a time of day of the form HH:MM into minutes after midnight
+func parseClock(text string) (int, error) {
+	clock, err := time.Parse("15:04", text)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day: %s", text)
+	}
+	return clock.Hour()*60 + clock.Minute(), nil
+}
+
+// Checks whether a rule applies at a time
+func (rule ScheduleRule) Applies(now time.Time) bool {
+	if rule.Weekdays && (now.Weekday() == time.Saturday || now.Weekday() == time.Sunday) {
+		return false
+	}
+	minute := now.Hour()*60 + now.Minute()
+	if rule.Start <= rule.End {
+		return minute >= rule.Start && minute < rule.End
+	}
+	return minute >= rule.Start || minute < rule.End
+}
+
+// Gets the rates at a time, which are the default rates when no rule applies
+func (s Schedule) Rates(now time.Time, download int, upload int) (int, int) {
+	for _, rule := range s {
+		if rule.Applies(now) {
+			return rule.Download, rule.Upload
+		}
+	}
+	return download, upload
+}
+
+// Applies the schedule to limits every minute until stop is closed, using the default rates when no rule applies
+func (s Schedule) Run(limits *Limits, download int, upload int, stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		limits.Set(s.Rates(time.Now(), download, upload))
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
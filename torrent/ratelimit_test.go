@@ -0,0 +1,102 @@
+package torrent
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(1000)
+	now := limiter.last
+
+	// A full bucket allows a second of transfer right away, after which callers wait
+	if wait := limiter.reserve(1000, now); wait != 0 {
+		t.Errorf("expected: no wait -> got: %v", wait)
+	}
+	if wait := limiter.reserve(500, now); wait != 500*time.Millisecond {
+		t.Errorf("expected: %v -> got: %v", 500*time.Millisecond, wait)
+	}
+	if wait := limiter.reserve(0, now.Add(time.Second)); wait != 0 {
+		t.Errorf("expected: debt to be repaid -> got: %v", wait)
+	}
+
+	// Changing the rate at runtime takes effect right away
+	limiter.SetRate(0)
+	if wait := limiter.reserve(1<<20, now.Add(time.Second)); wait != 0 {
+		t.Errorf("expected: unlimited rate -> got: %v", wait)
+	}
+}
+
+func TestLimitConnDeadline(t *testing.T) {
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	defer theirs.Close()
+	go theirs.Write(make([]byte, 3000))
+
+	// The second read waits half a second for the first to be repaid, which is longer than the deadline
+	conn := LimitConn(ours, NewLimits(1000, 0))
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	buf := make([]byte, 1500)
+	for i := range 2 {
+		if _, err := conn.Read(buf); err != nil {
+			t.Fatalf("read %d: %v", i, err)
+		}
+	}
+}
+
+func TestLimitConnClose(t *testing.T) {
+	ours, theirs := net.Pipe()
+	defer theirs.Close()
+
+	// A write that has to wait more than a minute for tokens stops once the connection is closed
+	conn := LimitConn(ours, NewLimits(0, 10))
+	time.AfterFunc(50*time.Millisecond, func() { conn.Close() })
+	start := time.Now()
+	if _, err := conn.Write(make([]byte, 1000)); err == nil || time.Since(start) > time.Second {
+		t.Errorf("expected: write to stop once closed -> got: %v after %v", err, time.Since(start))
+	}
+
+	// Waiting with a cancelled context does not sleep
+	limiter := NewRateLimiter(10)
+	limiter.Take(1000)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := limiter.Wait(ctx, 0); err != context.Canceled {
+		t.Errorf("expected: %v -> got: %v", context.Canceled, err)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	work, err := ParseScheduleRule("weekdays 09:00-17:00=512/64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	night, err := ParseScheduleRule("22:00-06:00=0/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	schedule := Schedule{work, night}
+
+	tests := []struct {
+		time     string
+		download int
+	}{
+		{"2024-01-08 10:00", 512 * 1024}, // Monday during work hours
+		{"2024-01-08 17:00", 100},        // Monday after work
+		{"2024-01-06 10:00", 100},        // Saturday
+		{"2024-01-06 23:30", 0},          // Wraps past midnight
+		{"2024-01-07 05:59", 0},
+	}
+	for _, test := range tests {
+		now, _ := time.Parse("2006-01-02 15:04", test.time)
+		if download, _ := schedule.Rates(now, 100, 100); download != test.download {
+			t.Errorf("%s: expected: %d -> got: %d", test.time, test.download, download)
+		}
+	}
+
+	if _, err := ParseScheduleRule("09:00-25:00=1/1"); err == nil {
+		t.Errorf("expected: error for invalid time of day")
+	}
+}
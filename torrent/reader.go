@@ -0,0 +1,103 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+const defaultReadahead int64 = 4 << 20 // Bytes past the read position that are downloaded before other pieces
+
+// A reader of a file of a torrent that is still downloading, which blocks until the pieces it reads are
+// downloaded and verified. The pieces at the read position and the readahead after it are downloaded
+// before any other piece, so seeking makes the download follow along, such as for a media player
+type Reader struct {
+	download  *Download
+	storage   *FileStorage
+	ctx       context.Context
+	offset    int64 // Offset of the file within the torrent
+	length    int64
+	pos       int64
+	first     int // First and last piece that are wanted by the reader, where last is below first if none are
+	last      int
+	Readahead int64 // Bytes past the read position that are made urgent along with it
+}
+
+// Creates a reader of a file of a torrent, which gives up waiting once ctx is cancelled. The reader
+// must be closed once it is no longer needed so that its pieces stop being urgent
+func (d *Download) NewReader(ctx context.Context, file File) *Reader {
+	storage := NewFileStorage(&d.Torrent, d.Destination)
+	storage.Skipped = d.fileSkipped
+	return &Reader{
+		download:  d,
+		storage:   storage,
+		ctx:       ctx,
+		offset:    int64(file.Offset),
+		length:    int64(file.Length),
+		first:     0,
+		last:      -1,
+		Readahead: defaultReadahead,
+	}
+}
+
+// Reads from the file, waiting for the piece at the read position. A read stops at the end of a piece
+// so that data which is already verified is returned without waiting for the pieces after it
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.pos >= r.length {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	torr := &r.download.Torrent
+	pieceLength := int64(torr.PieceLength)
+	at := r.offset + r.pos
+	index := int(at / pieceLength)
+	end := min(int64(index+1)*pieceLength, r.offset+r.length)
+	r.want(index, int((min(at+r.Readahead, r.offset+r.length)-1)/pieceLength))
+
+	err := r.download.WaitPiece(r.ctx, index)
+	if err != nil {
+		return 0, err
+	}
+	n, err := r.storage.ReadAt(p[:min(int64(len(p)), end-at)], at)
+	r.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Helper function to replace the pieces that the reader wants with a new range
+func (r *Reader) want(first int, last int) {
+	if first == r.first && last == r.last {
+		return
+	}
+	r.download.want(first, last, 1)
+	r.download.want(r.first, r.last, -1)
+	r.first, r.last = first, last
+}
+
+// Moves the read position, where the pieces at the new position are only wanted once they are read
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.length
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position: %d", offset)
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// Stops wanting any piece and closes the files of the reader
+func (r *Reader) Close() error {
+	r.want(0, -1)
+	return r.storage.Close()
+}
@@ -0,0 +1,44 @@
+package torrent
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReader(t *testing.T) {
+	torr := seededTorrent(t, 100000)
+	session := NewSession(SessionOptions{})
+	defer session.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	d, _ := session.AddTorrent(torr, filepath.Join(t.TempDir(), "out"), TorrentOptions{})
+
+	// Reading from the middle of the file waits for the pieces that are read, not for the whole torrent
+	reader := d.NewReader(ctx, torr.Files[0])
+	defer reader.Close()
+	if pos, err := reader.Seek(-40000, io.SeekEnd); err != nil || pos != 60000 {
+		t.Fatalf("expected: position %d -> got: %d (%v)", 60000, pos, err)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil || len(data) != 40000 || strings.Trim(string(data), "\x00") != "" {
+		t.Errorf("expected: %d zeros -> got: %d bytes (%v)", 40000, len(data), err)
+	}
+	if _, err := reader.Seek(-1, io.SeekStart); err == nil {
+		t.Errorf("expected: error for a negative position")
+	}
+
+	// Waiting on a piece of a removed torrent fails instead of blocking
+	if err := d.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	other, _ := sessionTorrent(t, strings.Repeat("a", 50000), "http://unused")
+	removed, _ := session.AddTorrent(other, filepath.Join(t.TempDir(), "other"), TorrentOptions{})
+	session.RemoveTorrent(removed.ID())
+	if err := removed.WaitPiece(ctx, 0); err == nil {
+		t.Errorf("expected: error for a removed torrent")
+	}
+}
@@ -0,0 +1,105 @@
+package torrent
+
+import (
+	"net"
+	"sync"
+)
+
+const banFailures int = 3     // Number of failed pieces a peer can be part of or blamed for before it may be banned
+const failurePenalty int = 10 // A failed piece outweighs this many valid pieces in the score of a peer
+
+// Scores peers by the pieces they deliver and bans peers that send bad data. Peers are identified by
+// their IP address, so a banned peer stays banned when it connects from another port. Bans last for
+// as long as the reputation is kept. It is safe for concurrent use
+type Reputation struct {
+	mutex sync.Mutex
+	peers map[string]*peerRecord
+}
+
+// The history of a peer
+type peerRecord struct {
+	verified int // Number of valid pieces the peer delivered blocks of
+	failed   int // Number of invalid pieces the peer delivered blocks of
+	culprit  int // Number of pieces the peer is known to have sent bad blocks of
+	banned   bool
+}
+
+// Creates a reputation where no peer is banned
+func NewReputation() *Reputation {
+	return &Reputation{peers: make(map[string]*peerRecord)}
+}
+
+// Records the verdict of a piece against every peer that delivered a block of it. Culprits are banned
+// once they are blamed for several pieces, so that a single bad piece such as from a bit flip is
+// forgiven, while peers that are only part of failed pieces are banned once their score drops below
+// zero after several failures. Returns the peers that were banned because of the verdict
+func (r *Reputation) Record(verdict Verdict) []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var banned []string
+	ban := func(record *peerRecord, peer string) {
+		if !record.banned {
+			record.banned = true
+			banned = append(banned, peer)
+		}
+	}
+	for _, peer := range verdict.Peers {
+		record := r.record(peer)
+		if verdict.Valid {
+			record.verified++
+			continue
+		}
+		record.failed++
+		if record.failed >= banFailures && record.score() < 0 {
+			ban(record, peer)
+		}
+	}
+	for _, peer := range verdict.Culprits {
+		record := r.record(peer)
+		record.culprit++
+		if record.culprit >= banFailures {
+			ban(record, peer)
+		}
+	}
+	return banned
+}
+
+// Checks whether a peer is banned
+func (r *Reputation) Banned(peer string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	record, ok := r.peers[peer]
+	return ok && record.banned
+}
+
+// Gets the score of a peer, where each failed piece outweighs many valid pieces
+func (r *Reputation) Score(peer string) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.record(peer).score()
+}
+
+// Helper function to get the record of a peer, creating it if needed
+func (r *Reputation) record(peer string) *peerRecord {
+	record, ok := r.peers[peer]
+	if !ok {
+		record = &peerRecord{}
+		r.peers[peer] = record
+	}
+	return record
+}
+
+// Helper function to compute the score of a peer
+func (record *peerRecord) score() int {
+	return record.verified - failurePenalty*record.failed
+}
+
+// Gets the identity of a peer from the address of its connection, which is its IP address
+func PeerAddress(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,87 @@
+package torrent
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSmartBan(t *testing.T) {
+	picker := NewPicker(pickerTorrent(1), nil)
+	bitfield := []byte{0b10000000}
+	good := bytes.Repeat([]byte{1}, int(blockSize))
+	bad := bytes.Repeat([]byte{2}, int(blockSize))
+
+	// Two peers each deliver a block of the piece and one of the blocks is bad
+	first, _ := picker.PickBlock(bitfield, nil, "honest")
+	second, _ := picker.PickBlock(bitfield, nil, "liar")
+	picker.AddBlock(first, good, "honest")
+	picker.AddBlock(second, bad, "liar")
+	verdict := picker.FinishPiece(0, false)
+	if verdict.Valid || len(verdict.Peers) != 2 || len(verdict.Culprits) != 0 {
+		t.Fatalf("unexpected verdict: %+v", verdict)
+	}
+	reputation := NewReputation()
+	if banned := reputation.Record(verdict); len(banned) != 0 {
+		t.Errorf("expected: no bans after a single failure -> got: %v", banned)
+	}
+
+	// The piece is downloaded again from the first peer to ask for it, which excludes every other peer
+	block, ok := picker.PickBlock(bitfield, nil, "honest")
+	if !ok {
+		t.Fatalf("expected: block of the failed piece")
+	}
+	if _, ok := picker.PickBlock(bitfield, nil, "liar"); ok {
+		t.Errorf("expected: failed piece to belong to a single peer")
+	}
+	rest, _ := picker.PickBlock(bitfield, []Block{block}, "honest")
+	picker.AddBlock(block, good, "honest")
+	picker.AddBlock(rest, good, "honest")
+
+	// Comparing the valid piece with the failed one reveals the peer that sent the bad block
+	verdict = picker.FinishPiece(0, true)
+	if !verdict.Valid || len(verdict.Culprits) != 1 || verdict.Culprits[0] != "liar" {
+		t.Fatalf("unexpected verdict: %+v", verdict)
+	}
+
+	// A single bad piece is forgiven, while a peer that is blamed again and again is banned
+	if banned := reputation.Record(verdict); len(banned) != 0 {
+		t.Errorf("expected: no bans after being blamed once -> got: %v", banned)
+	}
+	for range banFailures - 1 {
+		reputation.Record(verdict)
+	}
+	if !reputation.Banned("liar") || reputation.Banned("honest") {
+		t.Errorf("expected: only the liar to be banned")
+	}
+}
+
+func TestReputationSinglePeer(t *testing.T) {
+	// A failed piece that came from a single peer blames that peer, which is not enough for a ban
+	reputation := NewReputation()
+	failed := Verdict{false, []string{"alone"}, []string{"alone"}}
+	for i := range banFailures {
+		banned := reputation.Record(failed)
+		if (len(banned) > 0) != (i == banFailures-1) {
+			t.Errorf("failure %d: expected: ban only after %d failures -> got: %v", i+1, banFailures, banned)
+		}
+	}
+}
+
+func TestReputation(t *testing.T) {
+	reputation := NewReputation()
+	for range 40 {
+		reputation.Record(Verdict{true, []string{"trusted"}, nil})
+	}
+
+	// Peers that are part of several failed pieces are banned unless they delivered many valid pieces
+	failed := Verdict{false, []string{"trusted", "unknown"}, nil}
+	for range banFailures {
+		reputation.Record(failed)
+	}
+	if !reputation.Banned("unknown") || reputation.Banned("trusted") {
+		t.Errorf("expected: only the unknown peer to be banned")
+	}
+	if score := reputation.Score("trusted"); score != 40-banFailures*failurePenalty {
+		t.Errorf("expected: %d -> got: %d", 40-banFailures*failurePenalty, score)
+	}
+}
@@ -0,0 +1,11 @@
+package torrent
+
+import "context"
+
+// Checks the data already present in storage against the piece hashes of the torrent, which allows an
+// interrupted download to be resumed. Missing files and data that ends early are simply not complete, but
+// any other error while reading, such as a file that can't be opened, is returned since downloading would
+// fail to write there as well. Returns a slice that marks which pieces are complete
+func (t *Torrent) CheckExisting(ctx context.Context, storage Storage) ([]bool, error) {
+	return t.hashPieces(ctx, storage, true)
+}
@@ -0,0 +1,53 @@
+package torrent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCheckExisting(t *testing.T) {
+	data := []byte("aaaabbbbcc")
+	torr := Torrent{
+		PieceHashes: [][]byte{GetHash(data[:4]), GetHash(data[4:8]), GetHash(data[8:])},
+		PieceLength: 4,
+		Length:      uint32(len(data)),
+		Name:        "out",
+		Files:       []File{{Path: []string{"out"}, Length: uint32(len(data))}},
+	}
+	check := func(destination string) ([]bool, error) {
+		storage := NewFileStorage(&torr, destination)
+		defer storage.Close()
+		return torr.CheckExisting(context.Background(), storage)
+	}
+
+	// A missing destination means that nothing has been downloaded
+	destination := filepath.Join(t.TempDir(), "out")
+	got, err := check(destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, []bool{false, false, false}) {
+		t.Errorf("expected: no pieces -> got: %v", got)
+	}
+
+	// Corrupt the second piece and leave the last piece unwritten
+	os.WriteFile(destination, []byte("aaaabxbb"), 0644)
+	got, err = check(destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, []bool{true, false, false}) {
+		t.Errorf("expected: first piece -> got: %v", got)
+	}
+	if length := torr.CompletedLength(got); length != 4 {
+		t.Errorf("expected: %d -> got: %d", 4, length)
+	}
+
+	// A destination that can't be read is an error rather than nothing to resume
+	if got, err := check(t.TempDir()); err == nil {
+		t.Errorf("expected: error for a directory -> got: %v", got)
+	}
+}
@@ -0,0 +1,81 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The numbers of peers a tracker knows about for a torrent
+type ScrapeResult struct {
+	Complete   int `json:"complete"`   // Peers that have every piece
+	Incomplete int `json:"incomplete"` // Peers that are still downloading
+	Downloaded int `json:"downloaded"` // Number of times the torrent was completed
+}
+
+// Gets the numbers of peers of a torrent from its tracker without announcing ourselves
+// The format of a scrape can be found here: https://www.bittorrent.org/beps/bep_0048.html
+func (torrent *Torrent) Scrape(ctx context.Context) (ScrapeResult, error) {
+	base, err := ScrapeURL(torrent.Announce)
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+	base.RawQuery = url.Values{"info_hash": []string{string(torrent.InfoHash)}}.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base.String(), nil)
+	if err != nil {
+		return ScrapeResult{}, &DecodeError{"unable to parse tracker URL"}
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return ScrapeResult{}, &NetworkError{"failed to scrape tracker"}
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return ScrapeResult{}, &DecodeError{err.Error()}
+	}
+	if res.StatusCode != http.StatusOK {
+		return ScrapeResult{}, &NetworkError{fmt.Sprintf("failed to scrape tracker with status: %s", res.Status)}
+	}
+	return parseScrape(string(body), torrent.InfoHash)
+}
+
+// Gets the scrape URL of a tracker, which only exists when the last part of the announce URL starts with "announce"
+func ScrapeURL(announce string) (*url.URL, error) {
+	base, err := url.Parse(announce)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") {
+		return nil, &DecodeError{"unable to parse tracker URL"}
+	}
+	slash := strings.LastIndex(base.Path, "/")
+	if !strings.HasPrefix(base.Path[slash+1:], "announce") {
+		return nil, &NetworkError{"tracker does not support scraping"}
+	}
+	base.Path = base.Path[:slash+1] + "scrape" + strings.TrimPrefix(base.Path[slash+1:], "announce")
+	return base, nil
+}
+
+// Helper function that parses the numbers of peers of a torrent out of a scrape response
+func parseScrape(bencode string, infoHash []byte) (ScrapeResult, error) {
+	res, _, err := DecodeBencode(bencode)
+	if err != nil {
+		return ScrapeResult{}, &DecodeError{err.Error()}
+	}
+	dict, _ := res.(map[string]interface{})
+	if reason, ok := dict["failure reason"].(string); ok {
+		return ScrapeResult{}, &NetworkError{"tracker refused the scrape: " + reason}
+	}
+	files, _ := dict["files"].(map[string]interface{})
+	stats, ok := files[string(infoHash)].(map[string]interface{})
+	if !ok {
+		return ScrapeResult{}, &NetworkError{"tracker does not know the torrent"}
+	}
+	var result ScrapeResult
+	result.Complete, _ = stats["complete"].(int)
+	result.Incomplete, _ = stats["incomplete"].(int)
+	result.Downloaded, _ = stats["downloaded"].(int)
+	return result, nil
+}
@@ -0,0 +1,64 @@
+package torrent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestScrapeURL(t *testing.T) {
+	tests := []struct {
+		announce string
+		want     string
+	}{
+		{"http://example.com/announce", "http://example.com/scrape"},
+		{"http://example.com/x/announce.php?k=1", "http://example.com/x/scrape.php?k=1"},
+		{"http://example.com/a", ""},
+		{"udp://example.com:80/announce", ""},
+	}
+	for _, test := range tests {
+		got, err := ScrapeURL(test.announce)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("ScrapeURL(%s) = %s, want an error", test.announce, got)
+			}
+			continue
+		}
+		if err != nil || got.String() != test.want {
+			t.Errorf("ScrapeURL(%s) = %v, %v, want %s", test.announce, got, err, test.want)
+		}
+	}
+}
+
+func TestScrape(t *testing.T) {
+	var torr Torrent
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" || r.URL.Query().Get("info_hash") != string(torr.InfoHash) {
+			http.NotFound(w, r)
+			return
+		}
+		stats := map[string]interface{}{"complete": 3, "incomplete": 5, "downloaded": 8}
+		body, _ := EncodeBencode(map[string]interface{}{"files": map[string]interface{}{string(torr.InfoHash): stats}})
+		w.Write([]byte(body))
+	}))
+	defer tracker.Close()
+	torr, _ = sessionTorrent(t, strings.Repeat("scrape", 100), tracker.URL+"/announce")
+
+	got, err := torr.Scrape(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != (ScrapeResult{3, 5, 8}) {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestMagnet(t *testing.T) {
+	torr := Torrent{Announce: "http://example.com/announce", InfoHash: make([]byte, hashLength), Name: "a b", Length: 10}
+	want := "magnet:?xt=urn:btih:0000000000000000000000000000000000000000&dn=a+b&xl=10&tr=http%3A%2F%2Fexample.com%2Fannounce"
+	if got := torr.Magnet(); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,886 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultPort uint16 = 6881 // The default port as per the specification
+const peerIdPrefix = "-VT0001-" // Peer ids start with our client id and version, as most clients do
+
+// The status of a torrent in a session
+const (
+	StatusQueued      = "queued"   // Waiting for another torrent to finish
+	StatusChecking    = "checking" // Hash-checking data that is already on disk
+	StatusDownloading = "downloading"
+	StatusPaused      = "paused"
+	StatusFinished    = "finished"
+	StatusFailed      = "failed"
+	StatusRemoved     = "removed"
+)
+
+// Options of a session, where every field may be left empty
+type SessionOptions struct {
+	MaxActive    int       // Max number of torrents downloading at once, where zero is unlimited
+	Port         uint16    // The port that we accept connections on, which is told to trackers
+	Filter       *IPFilter // Peers blocked by the filter are never connected to
+	Limits       *Limits   // Limits shared by every torrent of the session, which default to unlimited
+	PeerIdPrefix string    // The start of our peer id, which defaults to our client id and version
+	Strategy     Strategy  // The strategy of torrents that do not have one, which defaults to rarest first
+
+	HandshakeTimeout time.Duration // Max time to connect to a peer, which defaults to DefaultHandshakeTimeout
+	Output           io.Writer     // Where the session prints what it is doing, which defaults to standard output
+}
+
+// A session which downloads several torrents at once while sharing a peer id, a listener, bandwidth
+// limits and banned peers between them. Torrents beyond the active limit wait in a queue in the order
+// they were added. It is safe for concurrent use
+type Session struct {
+	mutex      sync.Mutex
+	peerId     []byte
+	opts       SessionOptions
+	reputation *Reputation
+	downloads  []*Download // In queue order
+	listener   net.Listener
+	ctx        context.Context // Cancelled once the session is closed
+	cancel     context.CancelFunc
+	events     *Events
+}
+
+// Options of a torrent in a session, where every field may be left empty
+type TorrentOptions struct {
+	Limits   *Limits  // Limits of this torrent, which apply along with the limits of the session
+	Strategy Strategy // How pieces are picked, which defaults to the strategy of the session
+
+	// The priority of each file, where the pieces of a file take the highest priority of the files they
+	// overlap. Every file is of normal priority when empty
+	FilePriorities []Priority
+}
+
+// A torrent that belongs to a session
+type Download struct {
+	Torrent     Torrent
+	Destination string
+	session     *Session
+	opts        TorrentOptions
+
+	mutex    sync.Mutex
+	status   string
+	err      error
+	complete []bool             // Pieces that are done, which is nil until the data on disk is checked
+	cancel   context.CancelFunc // Stops the download while it is running
+	running  chan struct{}      // Closed once the download stops running
+	swarm    *Swarm             // The swarm of the download while it is running
+	picker   *Picker            // The picker of the download while it is running
+	ended    chan struct{}      // Closed once the download is finished, failed or removed
+	peers    map[string]PeerInfo
+	announce Announce      // The last time the tracker was asked for peers
+	readers  map[int]int   // Number of readers waiting on each piece
+	changed  chan struct{} // Closed and replaced whenever a piece is done, priorities change or the status changes
+	priority []Priority    // The priority of each piece as set by the user, where readers raise pieces to now
+	files    []Priority    // The priority of each file
+	playhead int           // The piece that was last read, which the streaming strategy picks in order from
+}
+
+// A peer that is connected to a torrent, as last reported by its worker
+type PeerInfo struct {
+	Address      string    `json:"address"`
+	Client       string    `json:"client"`
+	DownloadRate int       `json:"download_rate"` // Bytes per second
+	UploadRate   int       `json:"upload_rate"`
+	Connected    time.Time `json:"connected"`
+}
+
+// The result of asking a tracker for peers
+type Announce struct {
+	Time  time.Time // Zero until the tracker is first asked
+	Found int       // Number of peers the tracker returned
+	Err   error
+}
+
+// Creates a session with a random peer id
+func NewSession(opts SessionOptions) *Session {
+	if opts.Port == 0 {
+		opts.Port = defaultPort
+	}
+	if opts.Limits == nil {
+		opts.Limits = NewLimits(0, 0) // So that the limits of the session can be changed later
+	}
+	if opts.HandshakeTimeout == 0 {
+		opts.HandshakeTimeout = DefaultHandshakeTimeout
+	}
+	if opts.Output == nil {
+		opts.Output = os.Stdout
+	}
+	if opts.PeerIdPrefix == "" {
+		opts.PeerIdPrefix = peerIdPrefix
+	}
+	if opts.Strategy == "" {
+		opts.Strategy = StrategyRarest
+	}
+	peerId := make([]byte, peerIdSize)
+	n := copy(peerId, opts.PeerIdPrefix) // A prefix that is too long is cut short
+	rand.Read(peerId[n:])
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Session{peerId: peerId, opts: opts, reputation: NewReputation(), ctx: ctx, cancel: cancel, events: NewEvents()}
+}
+
+// Gets the events of every torrent in the session
+func (s *Session) Events() *Events {
+	return s.events
+}
+
+// Gets the peer id of the session
+func (s *Session) PeerId() []byte {
+	return s.peerId
+}
+
+// Accepts connections from peers on the port of the session, which are handed to the torrent they want
+func (s *Session) Listen() error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.opts.Port))
+	if err != nil {
+		return &NetworkError{"failed to listen: " + err.Error()}
+	}
+	s.mutex.Lock()
+	s.listener = listener
+	s.mutex.Unlock()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return // The listener was closed
+			}
+			go s.accept(conn)
+		}
+	}()
+	return nil
+}
+
+// Helper function to do the handshake with a peer that connected to us and hand it to its torrent
+func (s *Session) accept(conn net.Conn) {
+	ip := net.ParseIP(PeerAddress(conn.RemoteAddr()))
+	if !s.allow(ip) {
+		conn.Close()
+		return
+	}
+
+	conn.SetDeadline(time.Now().Add(s.opts.HandshakeTimeout))
+	handshake, err := ReadHandshake(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	var swarm *Swarm
+	d := s.find(handshake.InfoHash)
+	if d != nil {
+		d.mutex.Lock()
+		swarm = d.swarm
+		d.mutex.Unlock()
+	}
+	if swarm == nil || SendHandshake(conn, handshake.InfoHash, s.peerId) != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	swarm.Accept(LimitConn(conn, s.opts.Limits, d.opts.Limits), handshake)
+}
+
+// Helper function to check whether an address is neither blocked nor banned
+func (s *Session) allow(ip net.IP) bool {
+	if ip == nil {
+		return true
+	}
+	return !s.reputation.Banned(ip.String()) && (s.opts.Filter == nil || s.opts.Filter.Allow(ip))
+}
+
+// Helper function to find a torrent by its info hash
+func (s *Session) find(infoHash []byte) *Download {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, d := range s.downloads {
+		if bytes.Equal(d.Torrent.InfoHash, infoHash) {
+			return d
+		}
+	}
+	return nil
+}
+
+// Fetches the torrent of a magnet link from peers, which are filtered like the peers of any torrent.
+// Gives up once ctx is cancelled or the session is closed
+func (s *Session) FetchMetadata(ctx context.Context, magnet Magnet) (Torrent, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(s.ctx, cancel)
+	defer stop()
+	return magnet.FetchMetadata(ctx, s.peerId, MetadataOptions{s.opts.Port, s.allow, s.opts.HandshakeTimeout, s.opts.Output})
+}
+
+// Gets the limits shared by every torrent of the session, which can be changed at any time
+func (s *Session) Limits() *Limits {
+	return s.opts.Limits
+}
+
+// Adds a torrent to the queue of the session, which downloads to a destination
+func (s *Session) AddTorrent(torr Torrent, destination string, opts TorrentOptions) (*Download, error) {
+	if s.find(torr.InfoHash) != nil {
+		return nil, &TorrentError{"torrent already added"}
+	}
+	if opts.Limits == nil {
+		opts.Limits = NewLimits(0, 0) // So that the limits of the torrent can be changed later
+	}
+	if opts.Strategy == "" {
+		opts.Strategy = s.opts.Strategy
+	}
+	priority := make([]Priority, len(torr.PieceHashes))
+	for i := range priority {
+		priority[i] = PriorityNormal
+	}
+	files := make([]Priority, len(torr.Files))
+	for i := range files {
+		files[i] = PriorityNormal
+	}
+	if len(opts.FilePriorities) > 0 {
+		if len(opts.FilePriorities) != len(files) {
+			return nil, &TorrentError{"expected a priority for every file"}
+		}
+		copy(files, opts.FilePriorities)
+	}
+	d := &Download{
+		Torrent:     torr,
+		Destination: destination,
+		session:     s,
+		opts:        opts,
+		status:      StatusQueued,
+		ended:       make(chan struct{}),
+		peers:       make(map[string]PeerInfo),
+		readers:     make(map[int]int),
+		changed:     make(chan struct{}),
+		priority:    priority,
+		files:       files,
+	}
+	if len(opts.FilePriorities) > 0 {
+		d.applyFiles(0, len(priority)-1)
+	}
+	s.mutex.Lock()
+	s.downloads = append(s.downloads, d)
+	s.mutex.Unlock()
+	d.emit(d.StartedEvent())
+	s.schedule()
+	return d, nil
+}
+
+// Gets a torrent by its id, which is the info hash as hex
+func (s *Session) Get(id string) (*Download, error) {
+	infoHash, err := hex.DecodeString(id)
+	if err != nil {
+		return nil, &TorrentError{"invalid torrent id"}
+	}
+	d := s.find(infoHash)
+	if d == nil {
+		return nil, &TorrentError{"torrent not found"}
+	}
+	return d, nil
+}
+
+// Gets every torrent of the session in queue order
+func (s *Session) Torrents() []*Download {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]*Download{}, s.downloads...)
+}
+
+// Stops a torrent and removes it from the session, any data that was downloaded is kept
+func (s *Session) RemoveTorrent(id string) error {
+	d, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	for i := range s.downloads {
+		if s.downloads[i] == d {
+			s.downloads = append(s.downloads[:i], s.downloads[i+1:]...)
+			break
+		}
+	}
+	s.mutex.Unlock()
+	d.halt(StatusRemoved)
+	s.schedule()
+	return nil
+}
+
+// Stops a torrent until it is resumed, which keeps its place in the queue
+func (s *Session) Pause(id string) error {
+	d, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	if d.status != StatusQueued && d.status != StatusChecking && d.status != StatusDownloading {
+		d.mutex.Unlock()
+		return &TorrentError{"torrent is " + d.status}
+	}
+	d.mutex.Unlock()
+	d.halt(StatusPaused)
+	s.schedule()
+	return nil
+}
+
+// Queues a paused or failed torrent again
+func (s *Session) Resume(id string) error {
+	d, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	if d.status != StatusPaused && d.status != StatusFailed {
+		d.mutex.Unlock()
+		return &TorrentError{"torrent is " + d.status}
+	}
+	if d.status == StatusFailed {
+		d.ended = make(chan struct{})
+	}
+	d.status = StatusQueued
+	d.err = nil
+	d.mutex.Unlock()
+	s.schedule()
+	return nil
+}
+
+// Stops every torrent and the listener, then waits for every connection to close
+func (s *Session) Close() error {
+	s.cancel()
+	s.mutex.Lock()
+	downloads := s.downloads
+	s.downloads = nil
+	listener := s.listener
+	s.mutex.Unlock()
+	for _, d := range downloads {
+		d.halt(StatusRemoved)
+	}
+	if listener != nil {
+		return listener.Close()
+	}
+	return nil
+}
+
+// Helper function to start queued torrents while there are fewer active torrents than allowed
+func (s *Session) schedule() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	active := 0
+	for _, d := range s.downloads {
+		if status, _ := d.Status(); status == StatusChecking || status == StatusDownloading {
+			active++
+		}
+	}
+	for _, d := range s.downloads {
+		if s.opts.MaxActive > 0 && active >= s.opts.MaxActive {
+			return
+		}
+		d.mutex.Lock()
+		if d.status == StatusQueued {
+			d.status = StatusChecking
+			ctx, cancel := context.WithCancel(s.ctx)
+			d.cancel = cancel
+			d.running = make(chan struct{})
+			go d.run(ctx, d.running)
+			active++
+		}
+		d.mutex.Unlock()
+	}
+}
+
+// Gets the id of a torrent, which is the info hash as hex
+func (d *Download) ID() string {
+	return hex.EncodeToString(d.Torrent.InfoHash)
+}
+
+// Gets the status of a torrent and the error that made it fail, if any
+func (d *Download) Status() (string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.status, d.err
+}
+
+// Gets the number of pieces that are done and the number of pieces
+func (d *Download) Progress() (int, int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	done := 0
+	for i := range d.complete {
+		if d.complete[i] {
+			done++
+		}
+	}
+	return done, len(d.Torrent.PieceHashes)
+}
+
+// Gets which pieces are done, which is empty until the data on disk is checked
+func (d *Download) Pieces() []bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]bool{}, d.complete...)
+}
+
+// Blocks until a torrent is finished, failed or removed, returns the error that made it fail or the
+// error of ctx once it is cancelled
+func (d *Download) Wait(ctx context.Context) error {
+	d.mutex.Lock()
+	ended := d.ended
+	d.mutex.Unlock()
+	select {
+	case <-ended:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	_, err := d.Status()
+	return err
+}
+
+// Helper function to stop a torrent that may be running and wait for it to stop
+func (d *Download) halt(status string) {
+	d.mutex.Lock()
+	if d.status == StatusFinished || d.status == StatusRemoved {
+		d.mutex.Unlock()
+		return
+	}
+	running := d.running
+	if d.status == StatusChecking || d.status == StatusDownloading {
+		d.cancel()
+	}
+	d.status = status
+	if status == StatusRemoved && d.err == nil {
+		close(d.ended)
+	}
+	d.notify()
+	d.mutex.Unlock()
+	if running != nil {
+		<-running
+	}
+}
+
+// Helper function to run a torrent until it is finished, fails or ctx is cancelled
+func (d *Download) run(ctx context.Context, running chan struct{}) {
+	err := d.download(ctx)
+	d.mutex.Lock()
+	d.swarm = nil
+	d.picker = nil
+	select {
+	case <-ctx.Done():
+		// Stopped by a pause, a removal or the session closing, where the status is already set
+	default:
+		if err != nil {
+			d.status = StatusFailed
+			d.err = err
+		} else {
+			d.status = StatusFinished
+		}
+		close(d.ended)
+	}
+	d.notify()
+	close(running)
+	status := d.status
+	d.mutex.Unlock()
+	if status == StatusFailed {
+		d.emit(Event{Type: EventError, Err: err})
+	} else if status == StatusFinished {
+		done, total := d.Progress()
+		d.emit(Event{Type: EventFinished, Done: done, Total: total})
+	}
+	d.session.schedule()
+}
+
+// Helper function to wake everything waiting on the progress or status of a torrent, which must be called
+// with the mutex held
+func (d *Download) notify() {
+	close(d.changed)
+	d.changed = make(chan struct{})
+}
+
+// Helper function to mark pieces as wanted by a reader, which raises them to priority now until every
+// reader that wanted them has released them. The first piece that is wanted becomes the playhead
+func (d *Download) want(first int, last int, delta int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for i := first; i <= last; i++ {
+		d.readers[i] += delta
+		if d.readers[i] <= 0 {
+			delete(d.readers, i)
+		}
+	}
+	if delta > 0 {
+		d.playhead = first
+	}
+	d.update()
+}
+
+// Helper function to hand the priorities and strategy of a torrent to its picker, and to queue a finished
+// torrent again when pieces that were skipped are wanted. Must be called with the mutex held
+func (d *Download) update() {
+	priorities := append([]Priority{}, d.priority...)
+	for i := range d.readers {
+		if i >= 0 && i < len(priorities) {
+			priorities[i] = PriorityNow
+		}
+	}
+	if d.picker != nil {
+		d.picker.SetPriorities(priorities)
+		d.picker.SetStrategy(d.opts.Strategy, d.playhead)
+	}
+	if d.status == StatusFinished && !d.finished(d.complete) {
+		d.status = StatusQueued
+		d.ended = make(chan struct{})
+		go d.session.schedule()
+	}
+	d.notify()
+}
+
+// Helper function to check whether every piece is done apart from skipped pieces that no reader wants,
+// which must be called with the mutex held
+func (d *Download) finished(complete []bool) bool {
+	for i := range d.priority {
+		if (i >= len(complete) || !complete[i]) && (d.priority[i] != PrioritySkip || d.readers[i] > 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// Sets the priority of a range of pieces, where skipped pieces are never downloaded and a torrent is
+// finished once every other piece is done
+func (d *Download) SetPriority(first int, last int, priority Priority) error {
+	if first < 0 || last >= len(d.Torrent.PieceHashes) || first > last {
+		return &TorrentError{"piece out of range"}
+	}
+	if priority < PrioritySkip || priority > PriorityNow {
+		return &TorrentError{"invalid priority"}
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for i := first; i <= last; i++ {
+		d.priority[i] = priority
+	}
+	d.update()
+	return nil
+}
+
+// Gets the priority of each piece as set by the user
+func (d *Download) Priorities() []Priority {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]Priority{}, d.priority...)
+}
+
+// Sets the priority of a file, which sets the priority of its pieces to the highest priority of the files
+// that they overlap. Pieces that a skipped file shares with another file are still downloaded, where the
+// data of the skipped file is kept in a part file
+func (d *Download) SetFilePriority(index int, priority Priority) error {
+	if index < 0 || index >= len(d.Torrent.Files) || d.Torrent.Files[index].Padding {
+		return &TorrentError{"file out of range"}
+	}
+	if priority < PrioritySkip || priority > PriorityNow {
+		return &TorrentError{"invalid priority"}
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.files[index] = priority
+	first, last := d.Torrent.FilePieces(d.Torrent.Files[index])
+	d.applyFiles(first, last)
+	d.update()
+	return nil
+}
+
+// Gets the priority of each file
+func (d *Download) FilePriorities() []Priority {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]Priority{}, d.files...)
+}
+
+// Helper function to set the priority of the pieces from first to last to the highest priority of the
+// files that they overlap, which must be called with the mutex held
+func (d *Download) applyFiles(first int, last int) {
+	for i := first; i <= last; i++ {
+		d.priority[i] = PrioritySkip
+	}
+	for i, file := range d.Torrent.Files {
+		if file.Padding {
+			continue
+		}
+		begin, end := d.Torrent.FilePieces(file)
+		for j := max(begin, first); j <= min(end, last); j++ {
+			d.priority[j] = max(d.priority[j], d.files[i])
+		}
+	}
+}
+
+// Helper function to check whether a file is skipped, which decides where the storage keeps its data
+func (d *Download) fileSkipped(index int) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.files[index] == PrioritySkip
+}
+
+// Helper function to get the number of bytes that are left to download, where skipped pieces are not counted
+func (d *Download) left() uint32 {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	var left uint32
+	for i := range d.priority {
+		if (i >= len(d.complete) || !d.complete[i]) && (d.priority[i] != PrioritySkip || d.readers[i] > 0) {
+			left += uint32(d.Torrent.PieceSize(i))
+		}
+	}
+	return left
+}
+
+// Changes how the pieces of a torrent are picked, which applies right away
+func (d *Download) SetStrategy(strategy Strategy) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.opts.Strategy = strategy
+	d.update()
+}
+
+// Gets how the pieces of a torrent are picked
+func (d *Download) Strategy() Strategy {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.opts.Strategy
+}
+
+// Blocks until a piece is done, returns an error if the torrent fails or is removed first, or the error
+// of ctx once it is cancelled. A paused torrent is waited on until it is resumed
+func (d *Download) WaitPiece(ctx context.Context, index int) error {
+	if index < 0 || index >= len(d.Torrent.PieceHashes) {
+		return &TorrentError{"piece out of range"}
+	}
+	for {
+		d.mutex.Lock()
+		if index < len(d.complete) && d.complete[index] {
+			d.mutex.Unlock()
+			return nil
+		}
+		status, changed := d.status, d.changed
+		d.mutex.Unlock()
+		if status == StatusFailed || status == StatusRemoved {
+			return &TorrentError{"torrent is " + status}
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Gets the limits of a torrent, which apply along with the limits of the session and can be changed at any time
+func (d *Download) Limits() *Limits {
+	return d.opts.Limits
+}
+
+// Gets the peers that are connected to a torrent, ordered by address
+func (d *Download) Peers() []PeerInfo {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	peers := make([]PeerInfo, 0, len(d.peers))
+	for _, peer := range d.peers {
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Address < peers[j].Address })
+	return peers
+}
+
+// Gets the result of the last time the tracker of a torrent was asked for peers
+func (d *Download) LastAnnounce() Announce {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.announce
+}
+
+// Helper function to deliver an event of a torrent to the observers of its session, after keeping track
+// of its peers and tracker
+func (d *Download) emit(event Event) {
+	event.Torrent = d.ID()
+	event.Time = time.Now()
+	d.mutex.Lock()
+	switch event.Type {
+	case EventPeerConnected:
+		d.peers[event.Peer] = PeerInfo{Address: event.Peer, Connected: event.Time}
+	case EventPeerStats:
+		if peer, ok := d.peers[event.Peer]; ok {
+			peer.Client, peer.DownloadRate, peer.UploadRate = event.Client, event.DownloadRate, event.UploadRate
+			d.peers[event.Peer] = peer
+		}
+	case EventPeerDisconnected:
+		delete(d.peers, event.Peer)
+	case EventAnnounce:
+		d.announce = Announce{event.Time, event.Found, event.Err}
+	}
+	d.mutex.Unlock()
+	d.session.events.Emit(event)
+}
+
+// Gets the event that starts the events of a torrent, which describes its size
+func (d *Download) StartedEvent() Event {
+	torr := &d.Torrent
+	return Event{Type: EventStarted, Torrent: d.ID(), Time: time.Now(), Name: torr.Name, Length: int64(torr.Length),
+		PieceLength: int(torr.PieceLength), Total: len(torr.PieceHashes)}
+}
+
+// Helper function to download the missing pieces of a torrent, returns early once ctx is cancelled
+func (d *Download) download(ctx context.Context) error {
+	torr := &d.Torrent
+	storage := NewFileStorage(torr, d.Destination)
+	storage.Skipped = d.fileSkipped
+	defer storage.Close()
+	total := len(torr.PieceHashes)
+
+	// Hash-check any data left at the destination by an interrupted download, which only happens once
+	d.mutex.Lock()
+	complete := d.complete
+	d.mutex.Unlock()
+	if complete == nil {
+		var err error
+		complete, err = torr.CheckExisting(ctx, storage)
+		if err != nil {
+			return err
+		}
+		d.mutex.Lock()
+		d.complete = complete
+		d.notify()
+		d.mutex.Unlock()
+		done := 0
+		for i := range complete {
+			if complete[i] {
+				done++
+				d.emit(Event{Type: EventPieceCompleted, Piece: i, Done: done, Total: total})
+			}
+		}
+	}
+	d.mutex.Lock()
+	if ctx.Err() != nil {
+		d.mutex.Unlock()
+		return ctx.Err()
+	}
+	d.status = StatusDownloading
+	finished := d.finished(complete)
+	d.mutex.Unlock()
+	done, _ := d.Progress()
+	if finished {
+		fmt.Fprintf(d.session.opts.Output, "All %d wanted pieces of %d already present at %s \n", done, total, d.Destination)
+		return storage.ApplyAttributes()
+	}
+
+	// The tracker is asked again whenever the swarm runs low
+	session := d.session
+	var downloaded atomic.Uint32
+	downloaded.Store(torr.CompletedLength(complete))
+	tracker := func(ctx context.Context) ([]Peer, error) {
+		peers, err := torr.GetPeers(ctx, session.peerId, session.opts.Port, downloaded.Load(), d.left())
+		d.emit(Event{Type: EventAnnounce, Found: len(peers), Err: err})
+		return peers, err
+	}
+	peers, err := tracker(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Only missing pieces are picked by the workers
+	picker := NewPicker(torr, complete)
+	d.mutex.Lock()
+	d.picker = picker
+	d.update()
+	d.mutex.Unlock()
+	resQueue := make(chan *Result)
+	dial := func(ctx context.Context, peer Peer) (net.Conn, Handshake, error) {
+		conn, handshake, err := peer.PeerHandshake(ctx, torr.InfoHash, session.peerId, session.opts.HandshakeTimeout)
+		if err != nil {
+			return nil, Handshake{}, err
+		}
+		return LimitConn(conn, session.opts.Limits, d.opts.Limits), handshake, nil
+	}
+	serve := func(ctx context.Context, conn net.Conn, handshake Handshake) error {
+		peer := conn.RemoteAddr().String()
+		d.emit(Event{Type: EventPeerConnected, Peer: peer})
+		err := torr.PieceWorker(ctx, conn, handshake, picker, session.reputation, resQueue, d.emit, session.opts.Output)
+		d.emit(Event{Type: EventPeerDisconnected, Peer: peer, Err: err})
+		return err
+	}
+	swarm := NewSwarm(session.peerId, dial, serve, tracker)
+	swarm.Filter = func(peer Peer) bool { return session.allow(peer.IP) }
+	swarm.Output = session.opts.Output
+	swarm.AddPeers(peers)
+	d.mutex.Lock()
+	d.swarm = swarm
+	d.mutex.Unlock()
+	// The swarm is stopped once we return, which closes every connection and waits for every worker
+	swarmCtx, stopSwarm := context.WithCancel(ctx)
+	swarmDone := make(chan struct{})
+	go func() {
+		swarm.Run(swarmCtx)
+		close(swarmDone)
+	}()
+	defer func() {
+		stopSwarm()
+		<-swarmDone
+	}()
+
+	for {
+		// Pieces that are done according to the picker may still be waiting to be written
+		d.mutex.Lock()
+		finished, changed := d.finished(d.complete), d.changed
+		d.mutex.Unlock()
+		if finished {
+			break
+		}
+		var res *Result
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+			continue // Priorities may have changed, such as every remaining piece being skipped
+		case res = <-resQueue:
+		}
+		for _, banned := range res.Banned {
+			fmt.Fprintf(session.opts.Output, "Banned peer %s for sending bad data \n", banned)
+			d.emit(Event{Type: EventPeerBanned, Piece: res.Index, Peer: banned})
+		}
+		if !res.Verdict.Valid {
+			fmt.Fprintln(session.opts.Output, "failed integrity check")
+			d.emit(Event{Type: EventHashFailed, Piece: res.Index, Peers: res.Verdict.Peers})
+			continue
+		}
+		// Pieces are written as they complete so that an interrupted download can be resumed
+		_, err = storage.WriteAt(res.Result, int64(torr.PieceLength)*int64(res.Index))
+		if err != nil {
+			return err
+		}
+		done++
+		d.mutex.Lock()
+		d.complete[res.Index] = true
+		d.notify()
+		d.mutex.Unlock()
+		downloaded.Add(uint32(len(res.Result)))
+		connected, _ := swarm.Connections()
+		fmt.Fprintf(session.opts.Output, "Piece #%d complete (%d / %d) with %d peers \n", res.Index, done, total, connected)
+		d.emit(Event{Type: EventPieceCompleted, Piece: res.Index, Done: done, Total: total, Peers: res.Verdict.Peers})
+	}
+	fmt.Fprintf(session.opts.Output, "Download complete with %d bytes wasted during endgame \n", picker.Wasted())
+	if session.opts.Filter != nil {
+		addresses, attempts := session.opts.Filter.Rejected()
+		fmt.Fprintf(session.opts.Output, "Rejected %d blocked addresses %d times \n", addresses, attempts)
+	}
+	return storage.ApplyAttributes()
+}
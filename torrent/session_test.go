@@ -0,0 +1,327 @@
+package torrent
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Helper function to create a single file torrent of some data, whose tracker is at announce
+func sessionTorrent(t *testing.T, data string, announce string) (Torrent, string) {
+	path := filepath.Join(t.TempDir(), "data")
+	os.WriteFile(path, []byte(data), 0644)
+	bencode, err := Create(CreateOptions{Path: path, Announce: announce})
+	if err != nil {
+		t.Fatal(err)
+	}
+	torr, err := ParseMetainfo(bencode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return torr, path
+}
+
+// Helper function to wait for a torrent to reach a status
+func waitStatus(t *testing.T, d *Download, status string) {
+	for range 200 {
+		if got, _ := d.Status(); got == status {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	got, err := d.Status()
+	t.Fatalf("expected: %s -> got: %s (%v)", status, got, err)
+}
+
+func TestSession(t *testing.T) {
+	// A tracker without any peers, so that a torrent which is missing data keeps downloading
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali60e5:peers0:e"))
+	}))
+	defer tracker.Close()
+
+	session := NewSession(SessionOptions{MaxActive: 1})
+	defer session.Close()
+	missing, _ := sessionTorrent(t, strings.Repeat("a", 50000), tracker.URL)
+	present, path := sessionTorrent(t, strings.Repeat("b", 50000), tracker.URL)
+
+	// Only one torrent is active at once, so the second torrent waits in the queue
+	first, err := session.AddTorrent(missing, filepath.Join(t.TempDir(), "out"), TorrentOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pieces := 0
+	session.Events().Observe(func(event Event) {
+		if event.Type == EventPieceCompleted && event.Torrent == hex.EncodeToString(present.InfoHash) {
+			pieces++
+		}
+	})
+	second, _ := session.AddTorrent(present, path, TorrentOptions{})
+	if _, err := session.AddTorrent(present, path, TorrentOptions{}); err == nil {
+		t.Errorf("expected: error for a torrent that was already added")
+	}
+	waitStatus(t, first, StatusDownloading)
+	if status, _ := second.Status(); status != StatusQueued {
+		t.Errorf("expected: %s -> got: %s", StatusQueued, status)
+	}
+
+	// Pausing the first torrent lets the second one run, which finishes from the data on disk
+	if err := session.Pause(first.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if done, total := second.Progress(); done != total || pieces != total {
+		t.Errorf("expected: all %d pieces -> got: %d and %d callbacks", total, done, pieces)
+	}
+	waitStatus(t, first, StatusPaused)
+
+	// A resumed torrent runs again, and a removed torrent stops waiting
+	if err := session.Resume(first.ID()); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, first, StatusDownloading)
+	if err := session.RemoveTorrent(first.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(session.Torrents()) != 1 {
+		t.Errorf("expected: %d torrent -> got: %d", 1, len(session.Torrents()))
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali60e5:peers0:e"))
+	}))
+	defer tracker.Close()
+	baseline := runtimeGoroutines()
+
+	// Closing a session stops every torrent, and anything waiting on a torrent gives up with its context
+	session := NewSession(SessionOptions{Port: 16881})
+	if err := session.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	missing, _ := sessionTorrent(t, strings.Repeat("a", 50000), tracker.URL)
+	d, _ := session.AddTorrent(missing, filepath.Join(t.TempDir(), "out"), TorrentOptions{})
+	waitStatus(t, d, StatusDownloading)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := d.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected: %v -> got: %v", context.DeadlineExceeded, err)
+	}
+	session.Close()
+	if status, _ := d.Status(); status != StatusRemoved {
+		t.Errorf("expected: %s -> got: %s", StatusRemoved, status)
+	}
+	checkGoroutines(t, baseline)
+}
+
+// Helper function to count goroutines once idle connections of the HTTP client are closed
+func runtimeGoroutines() int {
+	http.DefaultClient.CloseIdleConnections()
+	return runtime.NumGoroutine()
+}
+
+// Helper function to check that every goroutine started since the baseline has finished
+func checkGoroutines(t *testing.T, baseline int) {
+	t.Helper()
+	for range 200 {
+		if runtimeGoroutines() <= baseline {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stack := make([]byte, 1<<16)
+	stack = stack[:runtime.Stack(stack, true)]
+	t.Errorf("expected: %d goroutines -> got: %d\n%s", baseline, runtime.NumGoroutine(), stack)
+}
+
+// Helper function to create a torrent of zeros whose tracker returns a single seeder with every piece
+func seededTorrent(t *testing.T, length int) Torrent {
+	torr, _ := sessionTorrent(t, string(make([]byte, length)), "http://unused")
+	return seed(t, torr)
+}
+
+// Helper function to point the tracker of a torrent of zeros to a single seeder with every piece
+func seed(t *testing.T, torr Torrent) Torrent {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := ReadHandshake(conn); err != nil {
+					return
+				}
+				SendHandshake(conn, torr.InfoHash, []byte("-XX0001-seeder000000"))
+				fakeSeeder(conn, len(torr.PieceHashes))
+			}()
+		}
+	}()
+	port := listener.Addr().(*net.TCPAddr).Port
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer := string([]byte{127, 0, 0, 1, byte(port >> 8), byte(port)})
+		w.Write([]byte("d8:intervali60e5:peers6:" + peer + "e"))
+	}))
+	t.Cleanup(tracker.Close)
+	torr.Announce = tracker.URL
+	return torr
+}
+
+func TestSessionDownload(t *testing.T) {
+	// A seeder with every piece of a torrent of zeros, which is the only peer of the tracker
+	torr := seededTorrent(t, 100000)
+	session := NewSession(SessionOptions{})
+	defer session.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	events := session.Events().Subscribe(ctx)
+	destination := filepath.Join(t.TempDir(), "out")
+	d, _ := session.AddTorrent(torr, destination, TorrentOptions{})
+	if err := d.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(destination)
+	if err != nil || len(data) != 100000 || strings.Trim(string(data), "\x00") != "" {
+		t.Errorf("expected: %d zeros -> got: %d bytes (%v)", 100000, len(data), err)
+	}
+	if announce := d.LastAnnounce(); announce.Found != 1 || announce.Err != nil {
+		t.Errorf("expected: %d peer from the tracker -> got: %+v", 1, announce)
+	}
+	seen := make(map[EventType]bool)
+	peers := make(map[string]bool)
+	for event := range events {
+		if event.Type == EventPeerStats {
+			peers[event.Peer] = true
+		}
+		seen[event.Type] = true
+		if event.Type == EventFinished {
+			break
+		}
+	}
+	for _, eventType := range []EventType{EventStarted, EventAnnounce, EventPeerConnected, EventPeerStats,
+		EventPieceRequested, EventBlockReceived, EventPieceCompleted} {
+		if !seen[eventType] {
+			t.Errorf("expected: %s event", eventType)
+		}
+	}
+	if len(peers) != 1 || len(d.Peers()) != 0 {
+		t.Errorf("expected: stats of %d peer that is gone once finished -> got: %v and %v", 1, peers, d.Peers())
+	}
+}
+
+func TestSessionPriority(t *testing.T) {
+	torr := seededTorrent(t, 100000)
+	session := NewSession(SessionOptions{Strategy: StrategySequential})
+	defer session.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// A torrent finishes once every piece that is not skipped is done
+	d, _ := session.AddTorrent(torr, filepath.Join(t.TempDir(), "out"), TorrentOptions{})
+	if d.Strategy() != StrategySequential {
+		t.Errorf("expected: strategy %s -> got: %s", StrategySequential, d.Strategy())
+	}
+	last := len(torr.PieceHashes) - 1
+	if err := d.SetPriority(1, last, PrioritySkip); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if done, _ := d.Progress(); done != 1 || !d.Pieces()[0] {
+		t.Errorf("expected: only piece %d -> got: %d pieces", 0, done)
+	}
+
+	// Wanting the skipped pieces again queues the torrent again
+	if err := d.SetPriority(1, last, PriorityNormal); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if done, total := d.Progress(); done != total {
+		t.Errorf("expected: all %d pieces -> got: %d", total, done)
+	}
+	if err := d.SetPriority(0, last+1, PriorityHigh); err == nil {
+		t.Errorf("expected: error for a piece out of range")
+	}
+}
+
+func TestSessionFiles(t *testing.T) {
+	// Three files of zeros in pieces of 32 KiB, so the second piece is shared by a and b and the third by b and c
+	dir := filepath.Join(t.TempDir(), "files")
+	os.Mkdir(dir, 0755)
+	for _, name := range []string{"a", "b", "c"} {
+		os.WriteFile(filepath.Join(dir, name), make([]byte, 40000), 0644)
+	}
+	bencode, err := Create(CreateOptions{Path: dir, PieceLength: 2 * blockSize, Announce: "http://unused"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	torr, _ := ParseMetainfo(bencode)
+	torr = seed(t, torr)
+	session := NewSession(SessionOptions{})
+	defer session.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Only the last piece belongs to c alone, and the data of c in the shared piece goes to its part file
+	destination := filepath.Join(t.TempDir(), "out")
+	skip := []Priority{PriorityNormal, PriorityNormal, PrioritySkip}
+	d, err := session.AddTorrent(torr, destination, TorrentOptions{FilePriorities: skip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if pieces := d.Pieces(); !pieces[2] || pieces[3] || d.left() != 0 {
+		t.Errorf("expected: every piece but the last -> got: %v with %d bytes left", pieces, d.left())
+	}
+	if _, err := os.Stat(filepath.Join(destination, "c")); err == nil {
+		t.Errorf("expected: no file for skipped file c")
+	}
+	if info, err := os.Stat(filepath.Join(destination, "c.part")); err != nil || info.Size() != 2*int64(blockSize)*3-80000 {
+		t.Errorf("expected: part file with the start of c -> got: %v (%v)", info, err)
+	}
+
+	// Wanting c again moves its part file into place and downloads the rest of it
+	if err := d.SetFilePriority(2, PriorityHigh); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(destination, "c"))
+	if err != nil || len(data) != 40000 || strings.Trim(string(data), "\x00") != "" {
+		t.Errorf("expected: %d zeros -> got: %d bytes (%v)", 40000, len(data), err)
+	}
+	if _, err := os.Stat(filepath.Join(destination, "c.part")); err == nil {
+		t.Errorf("expected: part file to be gone")
+	}
+	session.RemoveTorrent(d.ID())
+	if _, err := session.AddTorrent(torr, destination, TorrentOptions{FilePriorities: skip[:1]}); err == nil || len(session.Torrents()) != 0 {
+		t.Errorf("expected: error for missing file priorities")
+	}
+}
@@ -0,0 +1,215 @@
+package torrent
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// A storage holds the data of a torrent, where offsets are relative to the start of the first
+// file as if every file of the torrent were concatenated together
+type Storage interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+}
+
+// A file within a torrent, the path is relative to the download root
+type File struct {
+	Path       []string
+	Length     uint32
+	Offset     uint32 // Offset of the file within the torrent
+	PiecesRoot []byte // The merkle root of the file in v2 and hybrid torrents
+
+	// Attributes of the file, padding files are never written to disk
+	Padding     bool
+	Executable  bool
+	Hidden      bool
+	SymlinkPath []string // The target of a symlink relative to the download root
+	SHA1        []byte   // An optional hash of the whole file
+}
+
+// A storage backed by the files of a torrent on disk. Files are opened lazily, so
+// reading a file which does not exist fails while writing to it creates the file
+// Pieces may span a file that is skipped, so the data of a skipped file is kept in a part file next to
+// where the file would be, which becomes the file once it is no longer skipped
+type FileStorage struct {
+	root     string
+	multi    bool
+	files    []File
+	handles  []*os.File
+	paths    []string // The path that each handle was opened at
+	writable []bool
+	mutex    sync.Mutex
+
+	// Whether a file is skipped, which may change at any time. No file is skipped when nil
+	Skipped func(index int) bool
+}
+
+// Creates a storage for a torrent, for single file torrents path is the file itself
+// and for multi-file torrents path is the directory that holds the files
+func NewFileStorage(t *Torrent, path string) *FileStorage {
+	return &FileStorage{
+		root:     path,
+		multi:    t.MultiFile,
+		files:    t.Files,
+		handles:  make([]*os.File, len(t.Files)),
+		paths:    make([]string, len(t.Files)),
+		writable: make([]bool, len(t.Files)),
+	}
+}
+
+// Gets the location of a file on disk
+func (s *FileStorage) FilePath(index int) string {
+	if !s.multi {
+		return s.root
+	}
+	return filepath.Join(append([]string{s.root}, s.files[index].Path...)...)
+}
+
+// Gets the location of the part file that holds the data of a file while it is skipped
+func (s *FileStorage) PartPath(index int) string {
+	return s.FilePath(index) + ".part"
+}
+
+// Helper function to get where the data of a file is, which is its part file while the file is skipped
+// and does not exist. A part file is moved to the file once the file is no longer skipped
+func (s *FileStorage) location(index int) (string, error) {
+	path := s.FilePath(index)
+	skipped := s.Skipped(index)
+	if s.paths[index] == path || skipped && s.paths[index] == s.PartPath(index) {
+		return s.paths[index], nil // The file is already open where its data is
+	}
+	_, err := os.Stat(path)
+	exists := err == nil
+	if skipped {
+		if exists {
+			return path, nil
+		}
+		return s.PartPath(index), nil
+	}
+	if !exists {
+		err = os.Rename(s.PartPath(index), path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+	}
+	return path, nil
+}
+
+// Helper function to get a handle to a file, which is reopened when write access is needed or once the
+// data of the file moves
+func (s *FileStorage) open(index int, write bool) (*os.File, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	path := s.FilePath(index)
+	if s.Skipped != nil {
+		var err error
+		path, err = s.location(index)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.handles[index] != nil && s.paths[index] == path && (s.writable[index] || !write) {
+		return s.handles[index], nil
+	}
+
+	var handle *os.File
+	var err error
+	if write {
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return nil, err
+		}
+		var perm fs.FileMode = 0644
+		if s.files[index].Executable {
+			perm = 0755
+		}
+		handle, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, perm)
+	} else {
+		handle, err = os.Open(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if s.handles[index] != nil {
+		s.handles[index].Close()
+	}
+	s.handles[index] = handle
+	s.paths[index] = path
+	s.writable[index] = write
+	return handle, nil
+}
+
+// Helper function to split an operation across the files that a range of the torrent overlaps
+func (s *FileStorage) each(p []byte, off int64, write bool) (int, error) {
+	n := 0
+	for i, file := range s.files {
+		begin, end := int64(file.Offset), int64(file.Offset)+int64(file.Length)
+		if off+int64(n) >= end || off+int64(len(p)) <= begin || n == len(p) {
+			continue
+		}
+		chunk := p[n:min(len(p), int(end-off))]
+
+		// Padding is made of zeros that are never stored, and symlinks have no data of their own
+		if file.Padding || file.SymlinkPath != nil {
+			if !write {
+				clear(chunk)
+			}
+			n += len(chunk)
+			continue
+		}
+
+		handle, err := s.open(i, write)
+		if err != nil {
+			return n, err
+		}
+		var m int
+		if write {
+			m, err = handle.WriteAt(chunk, off+int64(n)-begin)
+		} else {
+			m, err = handle.ReadAt(chunk, off+int64(n)-begin)
+		}
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Reads len(p) bytes starting at off, which may span several files
+func (s *FileStorage) ReadAt(p []byte, off int64) (int, error) {
+	return s.each(p, off, false)
+}
+
+// Writes len(p) bytes starting at off, which may span several files
+func (s *FileStorage) WriteAt(p []byte, off int64) (int, error) {
+	return s.each(p, off, true)
+}
+
+// Closes every open file
+func (s *FileStorage) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var err error
+	for i := range s.handles {
+		if s.handles[i] != nil {
+			if closeErr := s.handles[i].Close(); closeErr != nil {
+				err = closeErr
+			}
+			s.handles[i] = nil
+			s.paths[i] = ""
+		}
+	}
+	return err
+}
@@ -0,0 +1,301 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const maxConnections int = 50            // Max number of peers we are connected to at once
+const maxHalfOpen int = 8                // Max number of connections that are still being dialed
+const maxFailures int = 8                // Peers that fail this many times in a row are forgotten
+const baseBackoff = 5 * time.Second      // The time before retrying a peer after its first failure
+const maxBackoff = 10 * time.Minute      // The longest time before retrying a peer
+const stableSession = time.Minute        // A session that lasts this long resets the failures of a peer
+const sourceInterval = 2 * time.Minute   // The shortest time between asking a peer source for more peers
+const swarmInterval = 1 * time.Second    // How often the swarm looks for peers to connect to
+const lowCandidates int = maxConnections // Peer sources are asked for more peers below this many candidates
+
+// A function that finds peers for a torrent, such as a tracker announce
+type PeerSource func(ctx context.Context) ([]Peer, error)
+
+// A function that dials a peer and does the handshake
+type PeerDialer func(ctx context.Context, peer Peer) (net.Conn, Handshake, error)
+
+// A function that communicates with a connected peer until the connection is finished or ctx is cancelled
+type PeerServer func(ctx context.Context, conn net.Conn, handshake Handshake) error
+
+// A connection manager which keeps a torrent connected to as many peers as allowed. Peers are
+// deduplicated by address and peer id, and peers that fail are retried with exponential back-off
+type Swarm struct {
+	mutex     sync.Mutex
+	peerId    []byte
+	dial      PeerDialer
+	serve     PeerServer
+	sources   []PeerSource
+	polled    time.Time
+	peers     map[string]*peerEntry // Keyed by the address of a peer
+	peerIds   map[string]bool       // Peer ids of connected peers
+	connected int
+	halfOpen  int
+	conns     map[net.Conn]bool // Connections that are being served
+	ctx       context.Context   // The context of the swarm while it is running
+	stopped   bool
+	sessions  sync.WaitGroup
+
+	// Peers that are rejected by the filter are never dialed, such as banned peers
+	Filter func(peer Peer) bool
+
+	// Where errors of the peer sources are printed, nothing is printed when nil
+	Output io.Writer
+}
+
+// A peer known to the swarm
+type peerEntry struct {
+	peer        Peer
+	failures    int
+	nextAttempt time.Time
+	active      bool // Whether the peer is being dialed or is connected
+	forgotten   bool // Whether the peer should never be dialed again, such as ourselves
+}
+
+// Creates a swarm which dials peers with dial and then hands each connection to serve
+func NewSwarm(peerId []byte, dial PeerDialer, serve PeerServer, sources ...PeerSource) *Swarm {
+	return &Swarm{
+		peerId:  peerId,
+		dial:    dial,
+		serve:   serve,
+		sources: sources,
+		peers:   make(map[string]*peerEntry),
+		peerIds: make(map[string]bool),
+		conns:   make(map[net.Conn]bool),
+	}
+}
+
+// Adds peers from any source, peers that are already known are ignored
+func (s *Swarm) AddPeers(peers []Peer) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, peer := range peers {
+		address := peer.String()
+		if s.Filter != nil && !s.Filter(peer) {
+			continue
+		}
+		if _, ok := s.peers[address]; !ok {
+			s.peers[address] = &peerEntry{peer: peer}
+		}
+	}
+}
+
+// Keeps the swarm topped up with connections until ctx is cancelled, then closes every connection
+// and returns once every connection is finished
+func (s *Swarm) Run(ctx context.Context) {
+	s.mutex.Lock()
+	s.ctx = ctx
+	s.mutex.Unlock()
+	ticker := time.NewTicker(swarmInterval)
+	defer ticker.Stop()
+	for {
+		s.poll(ctx)
+		s.connect()
+		select {
+		case <-ctx.Done():
+			s.close()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Helper function to close every connection and wait for them to finish
+func (s *Swarm) close() {
+	s.mutex.Lock()
+	s.stopped = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+	s.sessions.Wait()
+}
+
+// Serves a connection that a peer opened to us once the handshake is done, such as a connection
+// accepted by a listener. Returns an error if the connection is dropped, such as when the swarm is not running
+func (s *Swarm) Accept(conn net.Conn, handshake Handshake) error {
+	s.mutex.Lock()
+	ctx := s.ctx
+	if ctx == nil || s.stopped || s.connected+s.halfOpen >= maxConnections {
+		s.mutex.Unlock()
+		conn.Close()
+		return &NetworkError{"too many connections"}
+	}
+	s.halfOpen++
+	s.sessions.Add(1)
+	s.mutex.Unlock()
+
+	go func() {
+		defer s.sessions.Done()
+		start := time.Now()
+		id, ok := s.register(conn, handshake, nil)
+		if !ok {
+			return
+		}
+		s.serve(ctx, conn, handshake)
+		s.unregister(conn, id)
+		s.finish(nil, true, start, nil)
+	}()
+	return nil
+}
+
+// Gets the number of connected peers and the number of peers being dialed
+func (s *Swarm) Connections() (int, int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.connected, s.halfOpen
+}
+
+// Helper function to ask every peer source for more peers when the swarm is running low
+func (s *Swarm) poll(ctx context.Context) {
+	s.mutex.Lock()
+	candidates := 0
+	for _, entry := range s.peers {
+		if !entry.forgotten && !entry.active {
+			candidates++
+		}
+	}
+	due := candidates < lowCandidates && time.Since(s.polled) >= sourceInterval
+	if due {
+		s.polled = time.Now()
+	}
+	s.mutex.Unlock()
+	if !due {
+		return
+	}
+
+	for _, source := range s.sources {
+		peers, err := source(ctx)
+		if err != nil {
+			if s.Output != nil {
+				fmt.Fprintln(s.Output, err)
+			}
+			continue
+		}
+		s.AddPeers(peers)
+	}
+}
+
+// Helper function to dial as many peers as the limits allow
+func (s *Swarm) connect() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	for _, entry := range s.peers {
+		if s.connected+s.halfOpen >= maxConnections || s.halfOpen >= maxHalfOpen {
+			return
+		}
+		if entry.active || entry.forgotten || now.Before(entry.nextAttempt) {
+			continue
+		}
+		if s.Filter != nil && !s.Filter(entry.peer) {
+			entry.forgotten = true
+			continue
+		}
+		entry.active = true
+		s.halfOpen++
+		s.sessions.Add(1)
+		go s.session(s.ctx, entry)
+	}
+}
+
+// Helper function to dial a peer and serve it until it disconnects
+func (s *Swarm) session(ctx context.Context, entry *peerEntry) {
+	defer s.sessions.Done()
+	conn, handshake, err := s.dial(ctx, entry.peer)
+	if err != nil {
+		s.finish(entry, false, time.Now(), err)
+		return
+	}
+	id, ok := s.register(conn, handshake, entry)
+	if !ok {
+		return
+	}
+
+	start := time.Now()
+	err = s.serve(ctx, conn, handshake)
+	s.unregister(conn, id)
+	s.finish(entry, true, start, err)
+}
+
+// Helper function to move a connection from half-open to connected. Connections to ourselves, to peers
+// we are already connected to and connections made after the swarm stopped are closed, along with
+// returning false. The entry may be nil for connections that a peer opened to us
+func (s *Swarm) register(conn net.Conn, handshake Handshake, entry *peerEntry) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.halfOpen--
+	id := string(handshake.PeerId)
+	self := bytes.Equal(handshake.PeerId, s.peerId)
+	if self || s.peerIds[id] || s.stopped {
+		conn.Close()
+		if entry != nil {
+			entry.active = false
+			entry.forgotten = entry.forgotten || self
+			entry.nextAttempt = time.Now().Add(maxBackoff)
+		}
+		return "", false
+	}
+	s.peerIds[id] = true
+	s.conns[conn] = true
+	s.connected++
+	return id, true
+}
+
+// Helper function to forget a connection once it is finished
+func (s *Swarm) unregister(conn net.Conn, id string) {
+	conn.Close()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.peerIds, id)
+	delete(s.conns, conn)
+}
+
+// Helper function to schedule the next attempt of a peer once it disconnects or fails to connect
+// The entry may be nil for connections that a peer opened to us
+func (s *Swarm) finish(entry *peerEntry, connected bool, start time.Time, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if connected {
+		s.connected--
+	} else {
+		s.halfOpen--
+	}
+	if entry == nil {
+		return
+	}
+	entry.active = false
+
+	if err == nil {
+		return // Finished normally, so there is no reason to connect again
+	}
+	if connected && time.Since(start) >= stableSession {
+		entry.failures = 0
+	}
+	entry.failures++
+	if entry.failures >= maxFailures {
+		entry.forgotten = true
+		return
+	}
+	entry.nextAttempt = time.Now().Add(Backoff(entry.failures))
+}
+
+// Gets the time to wait before retrying a peer that has failed a number of times in a row
+func Backoff(failures int) time.Duration {
+	backoff := baseBackoff
+	for i := 1; i < failures && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxBackoff)
+}
@@ -0,0 +1,69 @@
+package torrent
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	expected := []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second}
+	for i, backoff := range expected {
+		if got := Backoff(i + 1); got != backoff {
+			t.Errorf("expected: %v -> got: %v", backoff, got)
+		}
+	}
+	if got := Backoff(100); got != maxBackoff {
+		t.Errorf("expected: %v -> got: %v", maxBackoff, got)
+	}
+}
+
+func TestSwarm(t *testing.T) {
+	self := []byte("-VT0001-000000000000")
+	other := []byte("-VT0001-111111111111")
+	ids := map[string][]byte{
+		"10.0.0.1:6881": self,
+		"10.0.0.2:6881": other,
+		"10.0.0.3:6881": other, // Same peer id under a different address
+	}
+	served := make(chan string, len(ids))
+	release := make(chan struct{})
+	dial := func(ctx context.Context, peer Peer) (net.Conn, Handshake, error) {
+		conn, _ := net.Pipe()
+		return conn, Handshake{PeerId: ids[peer.String()]}, nil
+	}
+	serve := func(ctx context.Context, conn net.Conn, handshake Handshake) error {
+		served <- string(handshake.PeerId)
+		<-release
+		return nil
+	}
+
+	swarm := NewSwarm(self, dial, serve)
+	swarm.AddPeers([]Peer{
+		{net.IPv4(10, 0, 0, 1), 6881},
+		{net.IPv4(10, 0, 0, 2), 6881},
+		{net.IPv4(10, 0, 0, 3), 6881},
+		{net.IPv4(10, 0, 0, 2), 6881}, // Duplicate address
+	})
+	swarm.ctx = context.Background()
+	swarm.connect()
+
+	// Only one connection should be served, since ourselves and the duplicate peer id are dropped
+	select {
+	case id := <-served:
+		if id != string(other) {
+			t.Errorf("expected: %s -> got: %s", other, id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no connection was served")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if connected, halfOpen := swarm.Connections(); connected != 1 || halfOpen != 0 {
+		t.Errorf("expected: 1 connected and 0 half-open -> got: %d and %d", connected, halfOpen)
+	}
+	if len(swarm.peers) != 3 || !swarm.peers["10.0.0.1:6881"].forgotten {
+		t.Errorf("expected the connection to ourselves to be forgotten")
+	}
+	close(release)
+}
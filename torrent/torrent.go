@@ -2,7 +2,10 @@ package torrent
 
 import (
 	"crypto/sha1"
+	"math"
 	"os"
+	"strings"
+	"time"
 )
 
 const hashLength int = 20
@@ -11,11 +14,23 @@ const hashLength int = 20
 // defined to make working with them easier. Typically, a hash has a constant length which is defined above
 type Torrent struct {
 	Announce    string
-	InfoHash    []byte
-	PieceHashes [][]byte
-	PieceLength uint32 // Length can't be negative
-	Length      uint32 // Length can't be negative
+	InfoHash    []byte // The SHA-1 info hash, or the truncated SHA-256 info hash for v2 only torrents
+	InfoHashV2  []byte // The SHA-256 info hash of v2 and hybrid torrents
+	MetaVersion int
+	PieceHashes [][]byte // SHA-1 hashes for v1 and hybrid torrents, merkle hashes for v2 only torrents
+	PieceLength uint32   // Length can't be negative
+	Length      uint32   // Length can't be negative
 	Name        string
+	Files       []File
+	MultiFile   bool // Multi-file torrents are stored in a directory
+
+	// Optional metadata that is not needed to download
+	AnnounceList [][]string // Tiers of trackers as per https://www.bittorrent.org/beps/bep_0012.html
+	URLList      []string   // Web seeds as per https://www.bittorrent.org/beps/bep_0019.html
+	Comment      string
+	CreatedBy    string
+	CreationDate time.Time // Zero when the torrent does not have one
+	Private      bool
 }
 
 // A structure to define errors that occur with parsing a torrent file
@@ -35,44 +50,233 @@ func ParseTorrent(filename string) (Torrent, error) {
 	if err != nil {
 		return Torrent{}, &TorrentError{"failed to read file"}
 	}
+	return ParseMetainfo(bytes)
+}
 
+// Parses the contents of a torrent file into a structure
+func ParseMetainfo(bytes []byte) (Torrent, error) {
 	res, _, err := DecodeBencode(string(bytes))
 	if err != nil {
 		return Torrent{}, &TorrentError{"invalid bencode: " + err.Error()}
 	}
 
 	// Populate the torrent structure using type assertion
-	metainfo := res.(map[string]interface{})
-	info := metainfo["info"].(map[string]interface{})
+	metainfo, _ := res.(map[string]interface{})
+	info, _ := metainfo["info"].(map[string]interface{})
 	if metainfo == nil || info == nil {
 		return Torrent{}, &TorrentError{"bencode missing keys"}
 	}
 
 	var file Torrent
-	file.Announce = metainfo["announce"].(string)
-	strInfoHash := metainfo["info bencoded"].(string)
-	strPieces := info["pieces"].(string)
-	file.PieceLength = uint32(info["piece length"].(int))
-	length, ok := info["length"].(int)
-	if !ok {
-		return Torrent{}, &TorrentError{"only support single file .torrents"}
-	}
-	file.Length = uint32(length)
-	file.Name = info["name"].(string)
-	if file.Announce == "" || strInfoHash == "" || strPieces == "" || file.PieceLength == 0 || file.Length == 0 || file.Name == "" {
+	file.Announce, _ = metainfo["announce"].(string)
+	parseMetadata(metainfo, info, &file)
+	if file.Announce == "" && len(file.AnnounceList) > 0 {
+		file.Announce = file.AnnounceList[0][0]
+	}
+	strInfoHash, _ := metainfo["info bencoded"].(string)
+	strPieces, _ := info["pieces"].(string)
+	pieceLength, _ := info["piece length"].(int)
+	file.PieceLength = uint32(pieceLength)
+	file.Name, _ = info["name"].(string)
+	file.MetaVersion, _ = info["meta version"].(int)
+	if file.MetaVersion == 0 {
+		file.MetaVersion = 1
+	}
+	if file.MetaVersion != 1 && file.MetaVersion != 2 {
+		return Torrent{}, &TorrentError{"unsupported meta version"}
+	}
+	if file.Announce == "" || strInfoHash == "" || file.PieceLength == 0 || file.Name == "" || !ValidPathComponent(file.Name) {
 		return Torrent{}, &TorrentError{"bencode missing values"}
 	}
 
-	// Calculate SHA-1 hash of the bencoded info dictionary and split piece hashes
-	file.InfoHash = GetHash([]byte(strInfoHash))
-	file.PieceHashes, err = SplitPieces(strPieces, hashLength)
-	if err != nil {
-		return Torrent{}, &TorrentError{err.Error()}
+	// Hybrid torrents contain both v1 and v2 keys, in which case the v1 layout and hashes are used
+	hybrid := file.MetaVersion == 2 && strPieces != ""
+	if file.MetaVersion == 1 || hybrid {
+		if length, ok := info["length"].(int); ok {
+			file.Length = uint32(length)
+			file.Files = []File{{Path: []string{file.Name}, Length: file.Length}}
+			err = ParseAttributes(info, &file.Files[0])
+			if err != nil {
+				return Torrent{}, err
+			}
+		} else {
+			file.MultiFile = true
+			file.Files, err = ParseFiles(info["files"])
+			if err != nil {
+				return Torrent{}, err
+			}
+			for _, f := range file.Files {
+				file.Length += f.Length
+			}
+		}
+		if strPieces == "" || file.Length == 0 {
+			return Torrent{}, &TorrentError{"bencode missing values"}
+		}
+
+		// Calculate SHA-1 hash of the bencoded info dictionary and split piece hashes
+		file.InfoHash = GetHash([]byte(strInfoHash))
+		file.PieceHashes, err = SplitPieces(strPieces, hashLength)
+		if err != nil {
+			return Torrent{}, &TorrentError{err.Error()}
+		}
+		if len(file.PieceHashes) != (int(file.Length)+int(file.PieceLength)-1)/int(file.PieceLength) {
+			return Torrent{}, &TorrentError{"number of pieces does not match length"}
+		}
+	}
+
+	if file.MetaVersion == 2 {
+		// Pieces of a v2 torrent are merkle trees of 16 KiB blocks
+		if file.PieceLength < blockSize || file.PieceLength&(file.PieceLength-1) != 0 {
+			return Torrent{}, &TorrentError{"piece length must be a power of two of at least 16 KiB"}
+		}
+		files, err := ParseFileTree(info["file tree"])
+		if err != nil {
+			return Torrent{}, err
+		}
+		if len(files) == 0 {
+			return Torrent{}, &TorrentError{"file tree has no files"}
+		}
+		file.InfoHashV2 = GetHashV2([]byte(strInfoHash))
+
+		// The v2 layout only differs from the v1 layout for v2 only torrents
+		var v2 Torrent = file
+		v2.Files = files
+		v2.Length = 0
+		v2.MultiFile = len(files) > 1 || len(files[0].Path) > 1 || files[0].Path[0] != file.Name
+		v2.layoutV2()
+		layers, _ := metainfo["piece layers"].(map[string]interface{})
+		hashes, err := v2.pieceHashesV2(layers)
+		if err != nil {
+			return Torrent{}, err
+		}
+
+		if hybrid {
+			err = file.attachPiecesRoots(files)
+			if err != nil {
+				return Torrent{}, err
+			}
+		} else {
+			file = v2
+			file.PieceHashes = hashes
+			file.InfoHash = file.InfoHashV2[:hashLength] // Truncated for the handshake and tracker
+			if file.Length == 0 {
+				return Torrent{}, &TorrentError{"bencode missing values"}
+			}
+		}
 	}
 
 	return file, nil
 }
 
+// Helper function to parse the optional metadata of a torrent, where values of the wrong type are ignored
+func parseMetadata(metainfo map[string]interface{}, info map[string]interface{}, file *Torrent) {
+	tiers, _ := metainfo["announce-list"].([]interface{})
+	for _, tier := range tiers {
+		list, _ := tier.([]interface{})
+		var trackers []string
+		for _, tracker := range list {
+			if str, ok := tracker.(string); ok && str != "" {
+				trackers = append(trackers, str)
+			}
+		}
+		if len(trackers) > 0 {
+			file.AnnounceList = append(file.AnnounceList, trackers)
+		}
+	}
+
+	// A single web seed may be given as a string rather than a list
+	switch seeds := metainfo["url-list"].(type) {
+	case string:
+		if seeds != "" {
+			file.URLList = []string{seeds}
+		}
+	case []interface{}:
+		for _, seed := range seeds {
+			if str, ok := seed.(string); ok && str != "" {
+				file.URLList = append(file.URLList, str)
+			}
+		}
+	}
+
+	file.Comment, _ = metainfo["comment"].(string)
+	file.CreatedBy, _ = metainfo["created by"].(string)
+	if date, ok := metainfo["creation date"].(int); ok {
+		file.CreationDate = time.Unix(int64(date), 0)
+	}
+	private, _ := info["private"].(int)
+	file.Private = private == 1
+}
+
+// Helper function to check that the v1 files of a hybrid torrent match its v2 files and to store their
+// pieces roots. Both lists are in the same order, although the v1 list may contain padding files
+func (t *Torrent) attachPiecesRoots(files []File) error {
+	j := 0
+	for i := range t.Files {
+		if t.Files[i].Padding {
+			continue
+		}
+		if j < len(files) && strings.Join(t.Files[i].Path, "/") == strings.Join(files[j].Path, "/") {
+			if t.Files[i].Length != files[j].Length {
+				return &TorrentError{"hybrid torrent has mismatched files"}
+			}
+			t.Files[i].PiecesRoot = files[j].PiecesRoot
+			j++
+		}
+	}
+	if j != len(files) {
+		return &TorrentError{"hybrid torrent has mismatched files"}
+	}
+	return nil
+}
+
+// Helper function to parse the files of a multi-file torrent, where each file is a dictionary
+// that contains its length and a list of path components
+func ParseFiles(bencode interface{}) ([]File, error) {
+	list, ok := bencode.([]interface{})
+	if !ok || len(list) == 0 {
+		return []File{}, &TorrentError{"bencode missing files"}
+	}
+
+	files := make([]File, 0, len(list))
+	var offset uint64
+	for i := range list {
+		dict, _ := list[i].(map[string]interface{})
+		length, ok := dict["length"].(int)
+		if !ok || length < 0 {
+			return []File{}, &TorrentError{"file missing length"}
+		}
+		components, _ := dict["path"].([]interface{})
+		path := make([]string, 0, len(components))
+		for j := range components {
+			component, _ := components[j].(string)
+			if !ValidPathComponent(component) {
+				return []File{}, &TorrentError{"file has invalid path"}
+			}
+			path = append(path, component)
+		}
+		if len(path) == 0 {
+			return []File{}, &TorrentError{"file has invalid path"}
+		}
+
+		files = append(files, File{Path: path, Length: uint32(length), Offset: uint32(offset)})
+		err := ParseAttributes(dict, &files[len(files)-1])
+		if err != nil {
+			return []File{}, err
+		}
+		offset += uint64(length)
+		if offset > math.MaxUint32 {
+			return []File{}, &TorrentError{"only support torrents smaller than 4 GiB"}
+		}
+	}
+
+	return files, nil
+}
+
+// Checks whether a component of a path is safe, components that escape the download root are never allowed
+func ValidPathComponent(component string) bool {
+	return component != "" && component != "." && component != ".." && !strings.ContainsAny(component, "/\\\x00")
+}
+
 // Helper function to split a string on every multiple of n (chunkLength)
 func SplitPieces(pieces string, chunkLength int) ([][]byte, error) {
 	if len(pieces)%chunkLength != 0 {
@@ -95,3 +299,28 @@ func GetHash(data []byte) []byte {
 	hasher.Write([]byte(data))
 	return hasher.Sum(nil)
 }
+
+// Gets the length of a specific piece, which is only smaller than the piece length on the last piece
+// In v2 only torrents, every file starts on a piece boundary so the last piece of each file may be smaller
+func (t *Torrent) PieceSize(index int) int {
+	if t.V2Only() {
+		file := t.PieceFile(index)
+		return int(min(t.PieceLength, file.Offset+file.Length-uint32(index)*t.PieceLength))
+	}
+	size := int(t.PieceLength)
+	if int(t.Length)-index*size < size {
+		size = int(t.Length) - index*size
+	}
+	return size
+}
+
+// Helper function to count the number of bytes that belong to complete pieces
+func (t *Torrent) CompletedLength(complete []bool) uint32 {
+	var length uint32
+	for i := range complete {
+		if complete[i] {
+			length += uint32(t.PieceSize(i))
+		}
+	}
+	return length
+}
@@ -0,0 +1,193 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"sort"
+)
+
+const merkleHashLength int = 32 // SHA-256 hashes are 32 bytes
+
+// Parses the file tree of a v2 torrent, where each directory is a dictionary of its children
+// and each file is a dictionary with an empty key that holds its length and pieces root
+// The format of a v2 torrent file can be found here:
+// https://www.bittorrent.org/beps/bep_0052.html#metainfo-files
+func ParseFileTree(bencode interface{}) ([]File, error) {
+	tree, ok := bencode.(map[string]interface{})
+	if !ok || len(tree) == 0 {
+		return []File{}, &TorrentError{"bencode missing file tree"}
+	}
+
+	var files []File
+	var walk func(node map[string]interface{}, path []string) error
+	walk = func(node map[string]interface{}, path []string) error {
+		// Keys of a bencoded dictionary are sorted, which determines the order of the files
+		names := make([]string, 0, len(node))
+		for name := range node {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			child, _ := node[name].(map[string]interface{})
+			if child == nil {
+				return &TorrentError{"file tree has invalid node"}
+			}
+			if name == "" {
+				// A file, whose path is every directory above it
+				length, ok := child["length"].(int)
+				if !ok || length < 0 || len(path) == 0 {
+					return &TorrentError{"file missing length"}
+				}
+				root, _ := child["pieces root"].(string)
+				if length > 0 && len(root) != merkleHashLength {
+					return &TorrentError{"file missing pieces root"}
+				}
+				files = append(files, File{Path: path, Length: uint32(length), PiecesRoot: []byte(root)})
+				err := ParseAttributes(child, &files[len(files)-1])
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if !ValidPathComponent(name) {
+				return &TorrentError{"file has invalid path"}
+			}
+			err := walk(child, append(path[:len(path):len(path)], name))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	err := walk(tree, []string{})
+	if err != nil {
+		return []File{}, err
+	}
+	return files, nil
+}
+
+// Helper function to lay out the files of a v2 torrent, where every file starts on a piece boundary
+func (t *Torrent) layoutV2() {
+	var offset uint32
+	for i := range t.Files {
+		t.Files[i].Offset = offset
+		t.Length += t.Files[i].Length
+		pieces := (t.Files[i].Length + t.PieceLength - 1) / t.PieceLength
+		offset += pieces * t.PieceLength
+	}
+}
+
+// Helper function to get the piece hashes of a v2 torrent in order, which are the piece layer hashes
+// of files larger than a piece and the pieces root of all other files. Every layer is checked against
+// the pieces root of its file
+func (t *Torrent) pieceHashesV2(layers map[string]interface{}) ([][]byte, error) {
+	var hashes [][]byte
+	for _, file := range t.Files {
+		if file.Length == 0 {
+			continue
+		}
+		if file.Length <= t.PieceLength {
+			hashes = append(hashes, file.PiecesRoot)
+			continue
+		}
+
+		layer, _ := layers[string(file.PiecesRoot)].(string)
+		pieces := int((file.Length + t.PieceLength - 1) / t.PieceLength)
+		if len(layer) != pieces*merkleHashLength {
+			return [][]byte{}, &TorrentError{"piece layers missing file"}
+		}
+		split, _ := SplitPieces(layer, merkleHashLength)
+		if !bytes.Equal(MerkleRoot(split, nextPowerOfTwo(pieces), zeroHash(t.pieceBlocks())), file.PiecesRoot) {
+			return [][]byte{}, &TorrentError{"piece layer does not match pieces root"}
+		}
+		hashes = append(hashes, split...)
+	}
+	return hashes, nil
+}
+
+// Checks whether a torrent only has v2 metadata, as opposed to a v1 or hybrid torrent
+func (t *Torrent) V2Only() bool {
+	return len(t.PieceHashes) > 0 && len(t.PieceHashes[0]) == merkleHashLength
+}
+
+// Gets the file that a piece belongs to, only meaningful for torrents where pieces do not span files
+func (t *Torrent) PieceFile(index int) File {
+	offset := uint32(index) * t.PieceLength
+	i := sort.Search(len(t.Files), func(i int) bool {
+		return t.Files[i].Offset+t.Files[i].Length > offset
+	})
+	if i == len(t.Files) {
+		return File{}
+	}
+	return t.Files[i]
+}
+
+// Helper function to check a piece of a v2 torrent against its merkle hash
+func (t *Torrent) validatePieceV2(piece []byte, index int) bool {
+	leaves := t.pieceBlocks()
+	// A file that fits within one piece has a tree that is only as large as the file requires
+	if file := t.PieceFile(index); file.Length <= t.PieceLength {
+		leaves = nextPowerOfTwo((len(piece) + int(blockSize) - 1) / int(blockSize))
+	}
+	return bytes.Equal(MerkleRoot(BlockHashes(piece), leaves, make([]byte, merkleHashLength)), t.PieceHashes[index])
+}
+
+// Gets the SHA-256 hash of every 16 KiB block, the last block may be shorter
+func BlockHashes(data []byte) [][]byte {
+	hashes := make([][]byte, 0, (len(data)+int(blockSize)-1)/int(blockSize))
+	for len(data) > 0 {
+		size := min(len(data), int(blockSize))
+		hashes = append(hashes, GetHashV2(data[:size]))
+		data = data[size:]
+	}
+	return hashes
+}
+
+// Calculates the root of a merkle tree with the given number of leaves (a power of two), where any
+// leaves beyond the given hashes are set to the padding hash
+func MerkleRoot(hashes [][]byte, leaves int, pad []byte) []byte {
+	layer := make([][]byte, leaves)
+	for i := range layer {
+		if i < len(hashes) {
+			layer[i] = hashes[i]
+		} else {
+			layer[i] = pad
+		}
+	}
+
+	for len(layer) > 1 {
+		next := make([][]byte, len(layer)/2)
+		for i := range next {
+			next[i] = GetHashV2(append(append([]byte{}, layer[2*i]...), layer[2*i+1]...))
+		}
+		layer = next
+	}
+	return layer[0]
+}
+
+// Helper function to get the number of blocks within a piece
+func (t *Torrent) pieceBlocks() int {
+	return int(t.PieceLength / blockSize)
+}
+
+// Helper function to calculate the root of a merkle tree with the given number of leaves that are all zero
+func zeroHash(leaves int) []byte {
+	return MerkleRoot(nil, leaves, make([]byte, merkleHashLength))
+}
+
+// Helper function to round up to a power of two
+func nextPowerOfTwo(n int) int {
+	power := 1
+	for power < n {
+		power *= 2
+	}
+	return power
+}
+
+// Helper function to calculate the SHA-256 hash
+func GetHashV2(data []byte) []byte {
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
@@ -0,0 +1,170 @@
+package torrent
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// Helper function to build every layer of a merkle tree from its leaves, padding with zero hashes
+func merkleLayers(leaves [][]byte) [][][]byte {
+	layer := make([][]byte, nextPowerOfTwo(len(leaves)))
+	for i := range layer {
+		if i < len(leaves) {
+			layer[i] = leaves[i]
+		} else {
+			layer[i] = make([]byte, merkleHashLength)
+		}
+	}
+	layers := [][][]byte{layer}
+	for len(layer) > 1 {
+		next := make([][]byte, len(layer)/2)
+		for i := range next {
+			next[i] = GetHashV2(append(append([]byte{}, layer[2*i]...), layer[2*i+1]...))
+		}
+		layers = append(layers, next)
+		layer = next
+	}
+	return layers
+}
+
+func TestParseMetainfoV2(t *testing.T) {
+	const pieceLength = 2 * 16384
+	large := []byte(strings.Repeat("a", 5*16384-100)) // 5 blocks, 3 pieces
+	small := []byte("small")
+
+	// The pieces root is built from every block whereas the piece layer has one hash for every two blocks
+	layers := merkleLayers(BlockHashes(large))
+	largeRoot := layers[len(layers)-1][0]
+	var pieceLayer []byte
+	for i := 0; i < 3; i++ {
+		pieceLayer = append(pieceLayer, layers[1][i]...)
+	}
+	smallRoot := merkleLayers(BlockHashes(small))[0][0]
+
+	metainfo := map[string]interface{}{
+		"announce": "http://example.com/announce",
+		"info": map[string]interface{}{
+			"name":         "root",
+			"meta version": 2,
+			"piece length": pieceLength,
+			"file tree": map[string]interface{}{
+				"large": map[string]interface{}{"": map[string]interface{}{"length": len(large), "pieces root": string(largeRoot)}},
+				"dir": map[string]interface{}{
+					"small": map[string]interface{}{"": map[string]interface{}{"length": len(small), "pieces root": string(smallRoot)}},
+				},
+			},
+		},
+		"piece layers": map[string]interface{}{string(largeRoot): string(pieceLayer)},
+	}
+	bencode, _ := EncodeBencode(metainfo)
+
+	torr, err := ParseMetainfo([]byte(bencode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !torr.V2Only() || !torr.MultiFile || len(torr.InfoHash) != hashLength || len(torr.InfoHashV2) != merkleHashLength {
+		t.Fatalf("unexpected torrent: %+v", torr)
+	}
+
+	// Files are sorted and start on piece boundaries
+	if len(torr.Files) != 2 || torr.Files[0].Path[1] != "small" || torr.Files[1].Offset != pieceLength {
+		t.Fatalf("unexpected files: %+v", torr.Files)
+	}
+	if len(torr.PieceHashes) != 4 || torr.PieceSize(0) != len(small) || torr.PieceSize(3) != len(large)-2*pieceLength {
+		t.Errorf("unexpected pieces: %d", len(torr.PieceHashes))
+	}
+
+	if !torr.ValidatePiece(small, 0) || !torr.ValidatePiece(large[2*pieceLength:], 3) {
+		t.Errorf("expected valid pieces")
+	}
+	corrupt := bytes.Clone(large[:pieceLength])
+	corrupt[0] = 'b'
+	if torr.ValidatePiece(corrupt, 1) {
+		t.Errorf("expected invalid piece")
+	}
+
+	// A piece layer that does not match its pieces root is rejected
+	metainfo["piece layers"] = map[string]interface{}{string(largeRoot): strings.Repeat("x", len(pieceLayer))}
+	bencode, _ = EncodeBencode(metainfo)
+	if _, err := ParseMetainfo([]byte(bencode)); err == nil {
+		t.Errorf("expected error for invalid piece layer")
+	}
+
+	// A file tree with only empty directories has no files
+	_, err = ParseMetainfo([]byte("d8:announce18:http://example.com4:infod9:file treed3:dirdee12:meta versioni2e4:name1:x12:piece lengthi16384eee"))
+	if _, ok := err.(*TorrentError); !ok {
+		t.Errorf("expected torrent error for empty file tree -> got: %v", err)
+	}
+}
+
+func TestParseMetainfoHybrid(t *testing.T) {
+	const pieceLength = 2 * 16384
+	large := []byte(strings.Repeat("a", 5*16384-100))
+	small := []byte("small")
+	largeLayers := merkleLayers(BlockHashes(large))
+	largeRoot := largeLayers[len(largeLayers)-1][0]
+	var pieceLayer []byte
+	for i := 0; i < 3; i++ {
+		pieceLayer = append(pieceLayer, largeLayers[1][i]...)
+	}
+	smallRoot := merkleLayers(BlockHashes(small))[0][0]
+
+	// The v1 files are padded so that every file starts on a piece boundary, as in the v2 layout
+	padding := pieceLength - len(small)
+	data := append(append(bytes.Clone(small), make([]byte, padding)...), large...)
+	var pieces []byte
+	for i := 0; i < len(data); i += pieceLength {
+		pieces = append(pieces, GetHash(data[i:min(i+pieceLength, len(data))])...)
+	}
+	info := map[string]interface{}{
+		"name":         "root",
+		"meta version": 2,
+		"piece length": pieceLength,
+		"pieces":       string(pieces),
+		"files": []interface{}{
+			map[string]interface{}{"length": len(small), "path": []interface{}{"dir", "small"}},
+			map[string]interface{}{"length": padding, "path": []interface{}{".pad", "32763"}, "attr": "p"},
+			map[string]interface{}{"length": len(large), "path": []interface{}{"large"}},
+		},
+		"file tree": map[string]interface{}{
+			"large": map[string]interface{}{"": map[string]interface{}{"length": len(large), "pieces root": string(largeRoot)}},
+			"dir": map[string]interface{}{
+				"small": map[string]interface{}{"": map[string]interface{}{"length": len(small), "pieces root": string(smallRoot)}},
+			},
+		},
+	}
+	metainfo := map[string]interface{}{
+		"announce":     "http://example.com/announce",
+		"info":         info,
+		"piece layers": map[string]interface{}{string(largeRoot): string(pieceLayer)},
+	}
+	bencode, _ := EncodeBencode(metainfo)
+	encodedInfo, _ := EncodeBencode(info)
+
+	torr, err := ParseMetainfo([]byte(bencode))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hybrid torrents use the v1 layout and hashes, while the v2 hash and pieces roots are kept
+	if torr.V2Only() || !bytes.Equal(torr.InfoHash, GetHash([]byte(encodedInfo))) || !bytes.Equal(torr.InfoHashV2, GetHashV2([]byte(encodedInfo))) {
+		t.Errorf("unexpected info hashes: %x %x", torr.InfoHash, torr.InfoHashV2)
+	}
+	if len(torr.Files) != 3 || !torr.Files[1].Padding || torr.Files[1].PiecesRoot != nil {
+		t.Fatalf("unexpected files: %+v", torr.Files)
+	}
+	if !bytes.Equal(torr.Files[0].PiecesRoot, smallRoot) || !bytes.Equal(torr.Files[2].PiecesRoot, largeRoot) {
+		t.Errorf("unexpected pieces roots: %x %x", torr.Files[0].PiecesRoot, torr.Files[2].PiecesRoot)
+	}
+	if len(torr.PieceHashes) != 4 || !torr.ValidatePiece(data[:pieceLength], 0) || !torr.ValidatePiece(data[3*pieceLength:], 3) {
+		t.Errorf("expected valid v1 pieces")
+	}
+
+	// Files that differ between the two layouts are rejected
+	info["files"].([]interface{})[2].(map[string]interface{})["length"] = len(large) - 1
+	bencode, _ = EncodeBencode(metainfo)
+	if _, err := ParseMetainfo([]byte(bencode)); err == nil {
+		t.Errorf("expected error for mismatched files")
+	}
+}
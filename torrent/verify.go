@@ -0,0 +1,127 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// The status of a file after verification
+const (
+	FileComplete = "complete" // Every piece of the file is valid
+	FilePartial  = "partial"  // Some pieces of the file are valid
+	FileInvalid  = "invalid"  // No pieces of the file are valid, which includes missing files
+)
+
+type FileStatus struct {
+	Path   string `json:"path"`
+	Length uint32 `json:"length"`
+	Status string `json:"status"`
+	Valid  int    `json:"valid"`  // Number of valid pieces that overlap the file
+	Pieces int    `json:"pieces"` // Number of pieces that overlap the file
+}
+
+// A structure to hold the result of verifying the data of a torrent
+type Verification struct {
+	Pieces []bool       `json:"pieces"`
+	Files  []FileStatus `json:"files"`
+}
+
+// Checks whether every piece and file was found to be valid
+func (v *Verification) Complete() bool {
+	for i := range v.Pieces {
+		if !v.Pieces[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Hashes every piece of the torrent found in storage in parallel and reports which pieces and files are valid,
+// where pieces that can't be read are invalid. Returns early with the error of ctx once it is cancelled
+func (t *Torrent) Verify(ctx context.Context, storage Storage) (*Verification, error) {
+	var v Verification
+	var err error
+	v.Pieces, err = t.hashPieces(ctx, storage, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// A file is only complete when every piece it overlaps is valid
+	for _, file := range t.Files {
+		if file.Padding {
+			continue
+		}
+		status := FileStatus{strings.Join(file.Path, "/"), file.Length, FileInvalid, 0, 0}
+		first, last := t.FilePieces(file)
+		for i := first; i <= last; i++ {
+			status.Pieces++
+			if v.Pieces[i] {
+				status.Valid++
+			}
+		}
+		if status.Valid == status.Pieces {
+			status.Status = FileComplete
+		} else if status.Valid > 0 {
+			status.Status = FilePartial
+		}
+		v.Files = append(v.Files, status)
+	}
+
+	return &v, nil
+}
+
+// Helper function to hash every piece found in storage in parallel. Missing files and data that ends early
+// only make pieces invalid, while other read errors are returned when strict is set
+func (t *Torrent) hashPieces(ctx context.Context, storage Storage, strict bool) ([]bool, error) {
+	pieces := make([]bool, len(t.PieceHashes))
+	indices := make(chan int, len(t.PieceHashes))
+	for i := range t.PieceHashes {
+		indices <- i
+	}
+	close(indices)
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	var wg sync.WaitGroup
+	for range runtime.NumCPU() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			piece := make([]byte, t.PieceLength)
+			for i := range indices {
+				if ctx.Err() != nil {
+					return
+				}
+				size := t.PieceSize(i)
+				_, err := storage.ReadAt(piece[:size], int64(t.PieceLength)*int64(i))
+				missing := errors.Is(err, fs.ErrNotExist) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+				if err != nil && !missing && strict {
+					cancel(fmt.Errorf("failed to read piece %d: %w", i, err))
+					return
+				}
+				pieces[i] = err == nil && t.ValidatePiece(piece[:size], i)
+			}
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return nil, context.Cause(ctx)
+	}
+	return pieces, nil
+}
+
+// Gets the indices of the first and last piece that a file overlaps, an empty file overlaps no pieces
+func (t *Torrent) FilePieces(file File) (int, int) {
+	if file.Length == 0 {
+		return 0, -1
+	}
+	first := int(file.Offset / t.PieceLength)
+	last := int((file.Offset + file.Length - 1) / t.PieceLength)
+	return first, last
+}
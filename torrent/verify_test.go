@@ -0,0 +1,80 @@
+package torrent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	data := []byte("aaaabbbbcc")
+	torr := Torrent{
+		PieceHashes: [][]byte{GetHash(data[:4]), GetHash(data[4:8]), GetHash(data[8:])},
+		PieceLength: 4,
+		Length:      uint32(len(data)),
+		Name:        "out",
+		Files:       []File{{Path: []string{"out"}, Length: uint32(len(data))}},
+	}
+
+	// A missing destination means that nothing has been downloaded
+	destination := filepath.Join(t.TempDir(), "out")
+	storage := NewFileStorage(&torr, destination)
+	got, _ := torr.Verify(context.Background(), storage)
+	storage.Close()
+	if !reflect.DeepEqual(got.Pieces, []bool{false, false, false}) || got.Files[0].Status != FileInvalid {
+		t.Errorf("expected: no pieces -> got: %v", got)
+	}
+
+	// Corrupt the second piece and leave the last piece unwritten
+	os.WriteFile(destination, []byte("aaaabxbb"), 0644)
+	storage = NewFileStorage(&torr, destination)
+	got, _ = torr.Verify(context.Background(), storage)
+	storage.Close()
+	if !reflect.DeepEqual(got.Pieces, []bool{true, false, false}) || got.Files[0].Status != FilePartial {
+		t.Errorf("expected: first piece -> got: %v", got)
+	}
+	if length := torr.CompletedLength(got.Pieces); length != 4 {
+		t.Errorf("expected: %d -> got: %d", 4, length)
+	}
+
+	// A cancelled check stops without a result
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	storage = NewFileStorage(&torr, destination)
+	defer storage.Close()
+	if got, err := torr.Verify(ctx, storage); err != context.Canceled {
+		t.Errorf("expected: %v -> got: %v %v", context.Canceled, got, err)
+	}
+}
+
+func TestFileStorage(t *testing.T) {
+	torr := Torrent{
+		MultiFile: true,
+		Files: []File{
+			{Path: []string{"a"}, Length: 3, Offset: 0},
+			{Path: []string{"empty"}, Length: 0, Offset: 3},
+			{Path: []string{"dir", "b"}, Length: 5, Offset: 3},
+		},
+	}
+	root := t.TempDir()
+	storage := NewFileStorage(&torr, root)
+	defer storage.Close()
+
+	// Writes and reads that cross a file boundary
+	_, err := storage.WriteAt([]byte("12345678"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	_, err = storage.ReadAt(buf, 2)
+	if err != nil || string(buf) != "3456" {
+		t.Errorf("expected: %q -> got: %q (%v)", "3456", buf, err)
+	}
+
+	b, _ := os.ReadFile(filepath.Join(root, "dir", "b"))
+	if string(b) != "45678" {
+		t.Errorf("expected: %q -> got: %q", "45678", b)
+	}
+}
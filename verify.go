@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/faisal-fawad/vistorrent/torrent"
+)
+
+// Verifies the data at a path against a torrent without downloading anything, the exit status
+// is 0 when all of the data is valid, 1 when any piece is invalid and 2 on any other error
+func verifyCommand(args []string) int {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print the result as JSON")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "invoke this command by using: ./vistorrent verify [--json] <input:file> <data:path>")
+		flags.PrintDefaults()
+	}
+	if flags.Parse(args) != nil {
+		return 2
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+
+	torr, err := torrent.ParseTorrent(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	storage := torrent.NewFileStorage(&torr, flags.Arg(1))
+	defer storage.Close()
+	res, err := torr.Verify(context.Background(), storage)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if *asJSON {
+		out, _ := json.MarshalIndent(res, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		for i, valid := range res.Pieces {
+			if !valid {
+				fmt.Printf("Piece #%d failed integrity check \n", i)
+			}
+		}
+		for _, file := range res.Files {
+			fmt.Printf("%s: %s (%d / %d pieces) \n", file.Path, file.Status, file.Valid, file.Pieces)
+		}
+	}
+
+	if !res.Complete() {
+		return 1
+	}
+	return 0
+}
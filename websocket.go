@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Opcodes of WebSocket frames
+const (
+	opContinuation byte = 0x0
+	opText         byte = 0x1
+	opBinary       byte = 0x2
+	opClose        byte = 0x8
+	opPing         byte = 0x9
+	opPong         byte = 0xA
+)
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11" // Appended to the key of the client as per the specification
+const maxMessageSize = 1 << 20                               // Largest message that a client may send
+const writeTimeout = 10 * time.Second                        // Max time to write a frame to a client that stopped reading
+
+// A WebSocket connection on the server side, where messages may be written by several goroutines while a
+// single goroutine reads them. Only what the dashboard needs is implemented: no extensions or subprotocols
+// The protocol can be found here: https://www.rfc-editor.org/rfc/rfc6455
+type wsConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	mutex  sync.Mutex // Held while writing a frame
+	closed bool
+}
+
+// Upgrades a request to a WebSocket connection, where any error has already been written as a response.
+// Pages on other origins are refused since browsers let any page open a WebSocket
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	fail := func(status int, reason string) (*wsConn, error) {
+		http.Error(w, reason, status)
+		return nil, errors.New(reason)
+	}
+	if r.Method != http.MethodGet || !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		return fail(http.StatusBadRequest, "expected a websocket upgrade")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return fail(http.StatusUpgradeRequired, "unsupported websocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return fail(http.StatusBadRequest, "invalid websocket key")
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if parsed, err := url.Parse(origin); err != nil || parsed.Host != r.Host {
+			return fail(http.StatusForbidden, "cross-origin requests are not allowed")
+		}
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return fail(http.StatusInternalServerError, "connection can't be upgraded")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	hash := sha1.Sum([]byte(key + websocketGUID))
+	accept := base64.StdEncoding.EncodeToString(hash[:])
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err = fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", accept)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return &wsConn{conn: conn, reader: rw.Reader}, nil
+}
+
+// Helper function to check whether a header holds a token in its comma separated list, ignoring case
+func headerContains(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Reads the next text or binary message, answering pings and closes along the way. Returns io.EOF
+// once the client closes the connection
+func (c *wsConn) ReadMessage() (byte, []byte, error) {
+	var opcode byte
+	var message []byte
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch op {
+		case opPing:
+			c.WriteMessage(opPong, payload)
+			continue
+		case opPong:
+			continue
+		case opClose:
+			// The close frame is echoed with the status code of the client, if any
+			if len(payload) >= 2 {
+				c.writeClose(binary.BigEndian.Uint16(payload))
+			} else {
+				c.writeClose(1000)
+			}
+			return 0, nil, io.EOF
+		case opText, opBinary:
+			if opcode != 0 {
+				return 0, nil, c.fail(1002, "expected a continuation frame")
+			}
+			opcode = op
+		case opContinuation:
+			if opcode == 0 {
+				return 0, nil, c.fail(1002, "unexpected continuation frame")
+			}
+		default:
+			return 0, nil, c.fail(1002, "unknown opcode")
+		}
+
+		if len(message)+len(payload) > maxMessageSize {
+			return 0, nil, c.fail(1009, "message too big")
+		}
+		message = append(message, payload...)
+		if fin {
+			if opcode == opText && !utf8.Valid(message) {
+				return 0, nil, c.fail(1007, "text message is not UTF-8")
+			}
+			return opcode, message, nil
+		}
+	}
+}
+
+// Helper function to read a single frame, whose payload is unmasked since every frame from a client is masked
+func (c *wsConn) readFrame() (bool, byte, []byte, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(c.reader, header)
+	if err != nil {
+		return false, 0, nil, err
+	}
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, c.fail(1002, "reserved bits are set")
+	}
+	if !masked {
+		return false, 0, nil, c.fail(1002, "frames from a client must be masked")
+	}
+	if opcode >= opClose && (!fin || length > 125) {
+		return false, 0, nil, c.fail(1002, "invalid control frame")
+	}
+
+	// Longer payloads have their length in the next 2 or 8 bytes
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		_, err = io.ReadFull(c.reader, extended)
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		_, err = io.ReadFull(c.reader, extended)
+		length = binary.BigEndian.Uint64(extended)
+	}
+	if err != nil {
+		return false, 0, nil, err
+	}
+	if length > maxMessageSize {
+		return false, 0, nil, c.fail(1009, "message too big")
+	}
+
+	mask := make([]byte, 4)
+	_, err = io.ReadFull(c.reader, mask)
+	if err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(c.reader, payload)
+	if err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// Writes a message as a single unmasked frame, which is safe to call from several goroutines
+func (c *wsConn) WriteMessage(opcode byte, payload []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	frame := make([]byte, 0, len(payload)+10)
+	frame = append(frame, 0x80|opcode)
+	switch {
+	case len(payload) <= 125:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	frame = append(frame, payload...)
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// Helper function to send a close frame with a status code, after which nothing else is written
+func (c *wsConn) writeClose(code uint16) {
+	c.WriteMessage(opClose, binary.BigEndian.AppendUint16(nil, code))
+	c.mutex.Lock()
+	c.closed = true
+	c.mutex.Unlock()
+}
+
+// Helper function to close the connection because the client broke the protocol
+func (c *wsConn) fail(code uint16, reason string) error {
+	c.writeClose(code)
+	return errors.New("websocket: " + reason)
+}
+
+// Closes the connection, telling the client first if the connection is still open
+func (c *wsConn) Close() error {
+	c.writeClose(1000)
+	return c.conn.Close()
+}
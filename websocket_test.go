@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// A frame as the client receives it
+type wsFrame struct {
+	opcode  byte
+	payload []byte
+}
+
+// Helper function to build a frame as a client sends it, where every frame of a real client is masked
+func clientFrame(fin bool, opcode byte, payload []byte, masked bool) []byte {
+	frame := []byte{opcode}
+	if fin {
+		frame[0] |= 0x80
+	}
+	var maskBit byte
+	if masked {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) <= 125:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	if !masked {
+		return append(frame, payload...)
+	}
+	mask := []byte{1, 2, 3, 4}
+	frame = append(frame, mask...)
+	for i := range payload {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	return frame
+}
+
+// Helper function to read a frame as the client, which the server never masks
+func readServerFrame(r io.Reader) (wsFrame, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return wsFrame{}, err
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		io.ReadFull(r, extended)
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		io.ReadFull(r, extended)
+		length = binary.BigEndian.Uint64(extended)
+	}
+	payload := make([]byte, length)
+	_, err := io.ReadFull(r, payload)
+	return wsFrame{header[0] & 0x0F, payload}, err
+}
+
+// Helper function to get the server side of a connection over a pipe along with the client end, where
+// the frames that the server writes are read as they arrive since writes to a pipe block until read
+func wsPipe(t *testing.T) (*wsConn, net.Conn, chan wsFrame) {
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	frames := make(chan wsFrame, 10)
+	go func() {
+		defer close(frames)
+		for {
+			frame, err := readServerFrame(client)
+			if err != nil {
+				return
+			}
+			frames <- frame
+		}
+	}()
+	return &wsConn{conn: server, reader: bufio.NewReader(server)}, client, frames
+}
+
+// Helper function to check that the server closed the connection with a status code
+func expectClose(t *testing.T, frames chan wsFrame, code uint16) {
+	frame := <-frames
+	if frame.opcode != opClose || len(frame.payload) < 2 || binary.BigEndian.Uint16(frame.payload) != code {
+		t.Errorf("expected: close %d -> got: %d %v", code, frame.opcode, frame.payload)
+	}
+}
+
+func TestWebSocketFrames(t *testing.T) {
+	// A message may be fragmented with a ping between its fragments, which is answered right away
+	conn, client, frames := wsPipe(t)
+	go func() {
+		client.Write(clientFrame(false, opText, []byte("Hel"), true))
+		client.Write(clientFrame(true, opPing, []byte("ping"), true))
+		client.Write(clientFrame(true, opContinuation, []byte("lo"), true))
+	}()
+	opcode, message, err := conn.ReadMessage()
+	if err != nil || opcode != opText || string(message) != "Hello" {
+		t.Errorf("expected: %q -> got: %q (%v)", "Hello", message, err)
+	}
+	if frame := <-frames; frame.opcode != opPong || string(frame.payload) != "ping" {
+		t.Errorf("expected: pong -> got: %d %q", frame.opcode, frame.payload)
+	}
+
+	// Messages longer than 65535 bytes use the longest length
+	large := bytes.Repeat([]byte("a"), 70000)
+	go conn.WriteMessage(opBinary, large)
+	if frame := <-frames; frame.opcode != opBinary || !bytes.Equal(frame.payload, large) {
+		t.Errorf("expected: %d bytes -> got: %d", len(large), len(frame.payload))
+	}
+
+	// A close is echoed with the status code of the client
+	go client.Write(clientFrame(true, opClose, binary.BigEndian.AppendUint16(nil, 1001), true))
+	if _, _, err := conn.ReadMessage(); err != io.EOF {
+		t.Errorf("expected: %v -> got: %v", io.EOF, err)
+	}
+	expectClose(t, frames, 1001)
+}
+
+func TestWebSocketProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames [][]byte
+		code   uint16
+	}{
+		{"unmasked", [][]byte{clientFrame(true, opText, []byte("hi"), false)}, 1002},
+		{"continuation first", [][]byte{clientFrame(true, opContinuation, []byte("hi"), true)}, 1002},
+		{"fragmented ping", [][]byte{clientFrame(false, opPing, nil, true)}, 1002},
+		{"invalid UTF-8", [][]byte{clientFrame(true, opText, []byte{0xff}, true)}, 1007},
+		{"oversized frame", [][]byte{{0x80 | opText, 0x80 | 127, 0, 0, 0, 0, 0, 0x20, 0, 0}}, 1009},
+		{"oversized message", [][]byte{
+			clientFrame(false, opBinary, make([]byte, maxMessageSize/2+1), true),
+			clientFrame(true, opContinuation, make([]byte, maxMessageSize/2+1), true),
+		}, 1009},
+	}
+	for _, test := range tests {
+		conn, client, frames := wsPipe(t)
+		go func() {
+			for _, frame := range test.frames {
+				client.Write(frame)
+			}
+		}()
+		if _, _, err := conn.ReadMessage(); err == nil || err == io.EOF {
+			t.Errorf("%s: expected a protocol error -> got: %v", test.name, err)
+		}
+		expectClose(t, frames, test.code)
+	}
+}
+
+// Helper function to send an upgrade request with the key from the example of the specification, where
+// headers are added to or replace the headers of the request
+func dialWebSocket(t *testing.T, address string, headers map[string]string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(address, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	req, _ := http.NewRequest(http.MethodGet, address+"/ws", nil)
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	for name, value := range headers {
+		if value == "" {
+			req.Header.Del(name)
+		} else {
+			req.Header.Set(name, value)
+		}
+	}
+	req.Write(conn)
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, reader, res
+}
+
+func TestUpgradeWebSocket(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgradeWebSocket(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		opcode, message, err := conn.ReadMessage()
+		if err == nil {
+			conn.WriteMessage(opcode, message)
+		}
+	}))
+	defer server.Close()
+
+	// The accept key is the one given by the example of the specification
+	conn, reader, res := dialWebSocket(t, server.URL, map[string]string{"Origin": server.URL})
+	if res.StatusCode != http.StatusSwitchingProtocols || res.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("unexpected response: %s %v", res.Status, res.Header)
+	}
+	conn.Write(clientFrame(true, opText, []byte("echo"), true))
+	if frame, err := readServerFrame(reader); err != nil || string(frame.payload) != "echo" {
+		t.Errorf("expected: %q -> got: %q (%v)", "echo", frame.payload, err)
+	}
+
+	tests := []struct {
+		headers map[string]string
+		status  int
+	}{
+		{map[string]string{"Upgrade": ""}, http.StatusBadRequest},
+		{map[string]string{"Sec-WebSocket-Version": "8"}, http.StatusUpgradeRequired},
+		{map[string]string{"Sec-WebSocket-Key": "c2hvcnQ="}, http.StatusBadRequest},
+		{map[string]string{"Origin": "http://evil.example"}, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		_, _, res := dialWebSocket(t, server.URL, test.headers)
+		if res.StatusCode != test.status {
+			t.Errorf("%v: expected: %d -> got: %d", test.headers, test.status, res.StatusCode)
+		}
+	}
+}